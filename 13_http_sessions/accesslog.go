@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ==========================================
+// ACCESS LOG
+// ==========================================
+// One log entry per request, written through log/slog so any pipeline can
+// parse it. Three formats:
+//
+//   json      {"time":"...","msg":"request","method":"GET","path":"/",...}
+//   logfmt    time=... level=INFO msg=request method=GET path=/ ...
+//   combined  Apache Combined Log Format, for tools that expect web-server logs
+
+// Where loggingMiddleware writes, set in main()
+var accessLog = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+// Build the access logger for a format name
+func newAccessLogger(format string, out io.Writer) (*slog.Logger, error) {
+	switch format {
+	case "json":
+		return slog.New(slog.NewJSONHandler(out, nil)), nil
+	case "logfmt":
+		return slog.New(slog.NewTextHandler(out, nil)), nil
+	case "combined":
+		return slog.New(&combinedHandler{out: out}), nil
+	default:
+		return nil, fmt.Errorf("unknown access log format: %s", format)
+	}
+}
+
+// ==========================================
+// COMBINED LOG FORMAT HANDLER
+// ==========================================
+
+// combinedHandler is a slog.Handler that prints the attributes written by
+// loggingMiddleware as an Apache Combined Log Format line:
+//
+//	host - user [time] "METHOD path PROTO" status bytes "referer" "agent"
+//
+// Attributes it doesn't know about are ignored.
+type combinedHandler struct {
+	mu    sync.Mutex
+	out   io.Writer
+	attrs []slog.Attr
+}
+
+func (h *combinedHandler) Enabled(context.Context, slog.Level) bool { return true }
+
+func (h *combinedHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &combinedHandler{out: h.out, attrs: append(append([]slog.Attr{}, h.attrs...), attrs...)}
+}
+
+func (h *combinedHandler) WithGroup(string) slog.Handler { return h }
+
+func (h *combinedHandler) Handle(_ context.Context, rec slog.Record) error {
+	fields := map[string]string{}
+	for _, a := range h.attrs {
+		fields[a.Key] = a.Value.String()
+	}
+	rec.Attrs(func(a slog.Attr) bool {
+		fields[a.Key] = a.Value.String()
+		return true
+	})
+
+	// "-" stands for "no value" in this format
+	get := func(key string) string {
+		if v := fields[key]; v != "" {
+			return v
+		}
+		return "-"
+	}
+	bytes := get("bytes")
+	if bytes == "0" {
+		bytes = "-"
+	}
+
+	line := fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %s %s %s %s\n",
+		get("remote"), get("user"), rec.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		get("method"), get("path"), get("proto"), get("status"), bytes,
+		strconv.Quote(get("referer")), strconv.Quote(get("user_agent")))
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.out, line)
+	return err
+}
+
+// ==========================================
+// ROTATING LOG FILE
+// ==========================================
+
+// rotatingFile is an io.Writer that starts a new file when the current one
+// reaches maxSize bytes or is older than maxAge. Old files are renamed to
+// path.YYYYMMDD-HHMMSS.micros and only the newest `keep` of them are kept.
+type rotatingFile struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64         // 0 = no size limit
+	maxAge  time.Duration // 0 = no time limit
+	keep    int           // 0 = keep every old file
+
+	file    *os.File
+	size    int64
+	created time.Time
+	retryAt time.Time // After a failed rotation, don't try again before this
+}
+
+// Suffix added to rotated files; sorts oldest first
+const backupTimeFormat = "20060102-150405.000000"
+
+func newRotatingFile(path string, maxSize int64, maxAge time.Duration, keep int) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize, maxAge: maxAge, keep: keep}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	tooBig := f.maxSize > 0 && f.size+int64(len(p)) > f.maxSize && f.size > 0
+	tooOld := f.maxAge > 0 && time.Since(f.created) > f.maxAge
+	if (tooBig || tooOld) && !time.Now().Before(f.retryAt) {
+		// On failure the current file is still open: keep logging to it
+		// rather than losing lines, and retry in a minute
+		if err := f.rotate(); err != nil {
+			log.Printf("access log: rotating %s: %v", f.path, err)
+			f.retryAt = time.Now().Add(time.Minute)
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
+
+// Open (or continue) the current file. Caller holds the lock.
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	f.created = time.Now()
+	if info.Size() > 0 {
+		f.created = info.ModTime() // Best guess for a file we are appending to
+	}
+	return nil
+}
+
+// Move the current file aside and start a fresh one. The old file is only
+// closed once the new one is open, so f.file is always usable, even when
+// this fails. Caller holds the lock.
+func (f *rotatingFile) rotate() error {
+	old := f.file
+	backup := f.path + "." + time.Now().Format(backupTimeFormat)
+	if err := os.Rename(f.path, backup); err != nil {
+		return err
+	}
+	if err := f.open(); err != nil {
+		return err // Still writing to old, now under the backup name
+	}
+	old.Close()
+	f.prune()
+	return nil
+}
+
+// Delete the oldest backups beyond f.keep. Only names rotate produces
+// count: "access.log.gz" or "access.log.bak" next to it are left alone.
+func (f *rotatingFile) prune() {
+	if f.keep <= 0 {
+		return
+	}
+	entries, err := os.ReadDir(filepath.Dir(f.path))
+	if err != nil {
+		return
+	}
+	prefix := filepath.Base(f.path) + "."
+	var backups []string
+	for _, e := range entries {
+		suffix, ok := strings.CutPrefix(e.Name(), prefix)
+		if !ok || e.IsDir() {
+			continue
+		}
+		if _, err := time.Parse(backupTimeFormat, suffix); err != nil {
+			continue
+		}
+		backups = append(backups, filepath.Join(filepath.Dir(f.path), e.Name()))
+	}
+	sort.Strings(backups) // Timestamps sort oldest first
+	for len(backups) > f.keep {
+		os.Remove(backups[0])
+		backups = backups[1:]
+	}
+}
+
+// Open the access log destination: "stdout", "stderr" or a file path
+func openAccessLogOutput(dest string, maxSizeMB int, maxAge time.Duration, keep int) (io.Writer, error) {
+	switch strings.ToLower(dest) {
+	case "", "stdout", "-":
+		return os.Stdout, nil
+	case "stderr":
+		return os.Stderr, nil
+	}
+	return newRotatingFile(dest, int64(maxSizeMB)<<20, maxAge, keep)
+}
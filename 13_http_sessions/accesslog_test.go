@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestRotatingFilePruneKeepsOtherFiles(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+	names := []string{
+		"access.log.20260101-000000.000001",
+		"access.log.20260102-000000.000001",
+		"access.log.20260103-000000.000001",
+		"access.log.gz",  // Not ours
+		"access.log.bak", // Not ours
+		"access.log.old-20260101-000000.000001",
+		"other.log.20260101-000000.000001",
+	}
+	for _, name := range names {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f := &rotatingFile{path: path, keep: 1}
+	f.prune()
+
+	entries, _ := os.ReadDir(dir)
+	var got []string
+	for _, e := range entries {
+		got = append(got, e.Name())
+	}
+	want := []string{
+		"access.log.20260103-000000.000001",
+		"access.log.bak",
+		"access.log.gz",
+		"access.log.old-20260101-000000.000001",
+		"other.log.20260101-000000.000001",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("left %v, want %v", got, want)
+	}
+}
+
+func TestShutdownHooksRunInReverse(t *testing.T) {
+	saved := shutdownHooks
+	shutdownHooks = nil
+	t.Cleanup(func() { shutdownHooks = saved })
+
+	var order []string
+	for _, name := range []string{"close access log", "flush session store", "close chat connections"} {
+		onShutdown(name, func(context.Context) error {
+			order = append(order, name)
+			return nil
+		})
+	}
+	runShutdownHooks(context.Background())
+
+	want := []string{"close chat connections", "flush session store", "close access log"}
+	if !slices.Equal(order, want) {
+		t.Errorf("ran %v, want %v", order, want)
+	}
+}
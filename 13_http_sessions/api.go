@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ==========================================
+// JSON HELPERS
+// ==========================================
+
+// Largest request body the API accepts
+const maxJSONBody = 1 << 20 // 1MB
+
+// writeJSON sends v as JSON with the given status code
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("writing JSON response: %v", err)
+	}
+}
+
+// FieldErrors maps a field name to what's wrong with it.
+// It's an error, so validation code can return it directly
+// (writeError turns it into a 400, see problem.go).
+type FieldErrors map[string]string
+
+func (e FieldErrors) Error() string {
+	fields := make([]string, 0, len(e))
+	for f := range e {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+	parts := make([]string, len(fields))
+	for i, f := range fields {
+		parts[i] = f + " " + e[f]
+	}
+	return "invalid input: " + strings.Join(parts, "; ")
+}
+
+// readJSON decodes the request body into dst. Unknown fields, trailing
+// data and oversized bodies are rejected with a 400/413/415 Problem.
+func readJSON(w http.ResponseWriter, r *http.Request, dst any) error {
+	if ct := r.Header.Get("Content-Type"); ct != "" && !strings.HasPrefix(ct, "application/json") {
+		return NewProblem(http.StatusUnsupportedMediaType, "Content-Type must be application/json")
+	}
+	bad := func(detail string) error { return NewProblem(http.StatusBadRequest, detail) }
+
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxJSONBody))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(dst); err != nil {
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		var sizeErr *http.MaxBytesError
+		switch {
+		case errors.Is(err, io.EOF):
+			return bad("request body is empty")
+		case errors.As(err, &syntaxErr):
+			return bad(fmt.Sprintf("malformed JSON at byte %d", syntaxErr.Offset))
+		case errors.As(err, &typeErr):
+			return validationProblem(FieldErrors{typeErr.Field: "has the wrong type"})
+		case errors.As(err, &sizeErr):
+			return NewProblem(http.StatusRequestEntityTooLarge,
+				fmt.Sprintf("request body larger than %d bytes", sizeErr.Limit))
+		case strings.HasPrefix(err.Error(), "json: unknown field "):
+			field, _ := strconv.Unquote(strings.TrimPrefix(err.Error(), "json: unknown field "))
+			return validationProblem(FieldErrors{field: "is not a known field"})
+		default:
+			return bad("malformed JSON")
+		}
+	}
+	if dec.More() {
+		return bad("request body must hold a single JSON object")
+	}
+	return nil
+}
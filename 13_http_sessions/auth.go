@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// ==========================================
+// ROLES AND PERMISSIONS
+// ==========================================
+// Users have roles (and optionally extra permissions). At login both are
+// copied into the session, with each role expanded into its permissions.
+// The protected routes read them again from the user store (one map
+// lookup), so a demoted user loses access on their next request, not at
+// their next login. API tokens do the same; JWTs pick up the change at
+// the next refresh.
+
+const (
+	roleAdmin  = "admin"
+	roleMember = "member"
+
+	permUsersRead      = "users:read"
+	permUsersWrite     = "users:write"
+	permLockoutsManage = "lockouts:manage"
+)
+
+// What each role may do
+var rolePermissions = map[string][]string{
+	roleAdmin:  {permUsersRead, permUsersWrite, permLockoutsManage},
+	roleMember: {permUsersRead},
+}
+
+// Roles new accounts get
+var defaultRoles = []string{roleMember}
+
+// Usernames that get the admin role, from -admins
+var bootstrapAdmins = map[string]bool{}
+
+func knownPermission(perm string) bool {
+	for _, perms := range rolePermissions {
+		if slices.Contains(perms, perm) {
+			return true
+		}
+	}
+	return false
+}
+
+// rolesFor returns the roles a new account starts with
+func rolesFor(username string) []string {
+	roles := slices.Clone(defaultRoles)
+	if bootstrapAdmins[strings.ToLower(username)] {
+		roles = append(roles, roleAdmin)
+	}
+	return roles
+}
+
+// effectivePermissions expands roles and adds the extra grants, sorted
+func effectivePermissions(roles, extra []string) []string {
+	set := map[string]bool{}
+	for _, role := range roles {
+		for _, perm := range rolePermissions[role] {
+			set[perm] = true
+		}
+	}
+	for _, perm := range extra {
+		set[perm] = true
+	}
+	perms := make([]string, 0, len(set))
+	for perm := range set {
+		perms = append(perms, perm)
+	}
+	sort.Strings(perms)
+	return perms
+}
+
+func (s *Session) HasRole(role string) bool { return slices.Contains(s.Roles, role) }
+func (s *Session) Can(perm string) bool     { return slices.Contains(s.Permissions, perm) }
+
+// grantBootstrapAdmins gives the admin role to -admins users that already
+// exist; new ones get it when they register (see rolesFor)
+func grantBootstrapAdmins(users UserStore) error {
+	for name := range bootstrapAdmins {
+		user, err := users.GetByUsername(name)
+		if err != nil {
+			continue // Not registered yet
+		}
+		if slices.Contains(user.Roles, roleAdmin) {
+			continue
+		}
+		_, err = users.Modify(user.ID, func(u *User) error {
+			u.Roles = append(slices.Clone(u.Roles), roleAdmin)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		log.Printf("Granted admin role to '%s'", user.Username)
+	}
+	return nil
+}
+
+// ==========================================
+// AUTH MIDDLEWARE
+// ==========================================
+//   protected := router.Group("", RequireAuth)
+//   admin := router.Group("/admin", RequireRole("admin"))
+//   api.Group("/users", RequirePermission("users:write"))
+//
+// Not logged in: browsers are redirected to the login form with ?next=
+// pointing back; API clients get a 401 problem. Logged in without the
+// role or permission: 403.
+
+type sessionCtxKey struct{}
+
+// currentSession returns the session RequireAuth found, or looks it up
+func currentSession(r *http.Request) *Session {
+	if s, ok := r.Context().Value(sessionCtxKey{}).(*Session); ok {
+		return s
+	}
+	return getSession(r)
+}
+
+// RequireAuth lets through logged-in users only
+func RequireAuth(next http.Handler) http.Handler {
+	return requireSession(func(*Session) bool { return true }, "", next)
+}
+
+// RequireRole lets through users with at least one of roles
+func RequireRole(roles ...string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return requireSession(func(s *Session) bool {
+			return slices.ContainsFunc(roles, s.HasRole)
+		}, "This needs the "+strings.Join(roles, " or ")+" role.", next)
+	}
+}
+
+// RequirePermission lets through users whose roles grant perm
+func RequirePermission(perm string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return requireSession(func(s *Session) bool {
+			return s.Can(perm)
+		}, "This needs the "+perm+" permission.", next)
+	}
+}
+
+func requireSession(allowed func(*Session) bool, denied string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session := currentSession(r)
+		if session != nil && !bearerAuthenticated(r) {
+			var err error
+			if session, err = withCurrentRoles(session); err != nil {
+				writeError(w, r, err)
+				return
+			}
+		}
+		if session == nil {
+			unauthenticated(w, r)
+			return
+		}
+		if !allowed(session) {
+			writeProblem(w, r, NewProblem(http.StatusForbidden, denied))
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), sessionCtxKey{}, session)))
+	})
+}
+
+// withCurrentRoles returns a copy of a cookie session with the user's
+// roles and permissions as they are now, or nil if the account was
+// deleted (or deleted and registered again) since the login
+func withCurrentRoles(session *Session) (*Session, error) {
+	user, err := userStore.GetByUsername(session.Username)
+	if errors.Is(err, ErrUserNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if user.CreatedAt.After(session.LoginTime) {
+		return nil, nil
+	}
+	s := session.clone()
+	s.Roles = slices.Clone(user.Roles)
+	s.Permissions = effectivePermissions(user.Roles, user.Permissions)
+	return s, nil
+}
+
+// Browsers go to the login form and come back after, APIs get a 401
+func unauthenticated(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet && prefersHTML(r) {
+		http.Redirect(w, r, "/?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+		return
+	}
+	writeProblem(w, r, NewProblem(http.StatusUnauthorized, "Log in first."))
+}
+
+// safeNext only allows paths on this site as a redirect target, so
+// ?next=https://evil.example can't turn login into an open redirect
+func safeNext(next string) string {
+	u, err := url.Parse(next)
+	if err != nil || next == "" || u.IsAbs() || u.Host != "" ||
+		!strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return u.RequestURI()
+}
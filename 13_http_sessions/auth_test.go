@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+// Roles are read from the user store on each protected request, so a
+// demotion or a deleted account takes effect without a new login
+func TestRequirePermissionRereadsRoles(t *testing.T) {
+	usersAPI(t) // Fresh stores
+	alice := &User{Username: "alice", Roles: []string{roleAdmin}, CreatedAt: time.Now().Add(-time.Hour)}
+	if err := userStore.Create(alice); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	store.Save("alice-session", &Session{
+		Username:    "alice",
+		LoginTime:   now,
+		LastAccess:  now,
+		ExpiresAt:   now.Add(time.Hour),
+		Roles:       []string{roleAdmin},
+		Permissions: effectivePermissions([]string{roleAdmin}, nil),
+	})
+	h := RequirePermission(permUsersWrite)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !slices.Equal(currentSession(r).Roles, []string{roleAdmin}) {
+			t.Errorf("handler sees roles %v", currentSession(r).Roles)
+		}
+	}))
+	call := func() int {
+		r := httptest.NewRequest("GET", "/api/users", nil)
+		r.AddCookie(&http.Cookie{Name: sessionCookieName, Value: "alice-session"})
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if code := call(); code != http.StatusOK {
+		t.Fatalf("admin: %d", code)
+	}
+
+	userStore.Modify(alice.ID, func(u *User) error {
+		u.Roles = []string{roleMember}
+		return nil
+	})
+	if code := call(); code != http.StatusForbidden {
+		t.Errorf("demoted: %d, want 403", code)
+	}
+	if s, _ := store.Get("alice-session"); !slices.Equal(s.Roles, []string{roleAdmin}) {
+		t.Errorf("stored session was changed: %v", s.Roles)
+	}
+
+	// Deleted, then someone registers the name again: the old login is not theirs
+	userStore.Delete(alice.ID)
+	if code := call(); code != http.StatusUnauthorized {
+		t.Errorf("deleted: %d, want 401", code)
+	}
+	userStore.Create(&User{Username: "alice", Roles: []string{roleAdmin}, CreatedAt: time.Now().Add(time.Minute)})
+	if code := call(); code != http.StatusUnauthorized {
+		t.Errorf("registered again: %d, want 401", code)
+	}
+}
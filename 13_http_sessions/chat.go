@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf16"
+)
+
+// ==========================================
+// CHAT ROOM
+// ==========================================
+//   GET /chat      the chat page (static/chat.js opens the socket)
+//   GET /chat/ws   WebSocket, logged-in users only (session cookie)
+//
+// Clients send plain text; everyone gets JSON events:
+//
+//   {"type":"message","user":"alice","text":"hi","time":"..."}
+//   {"type":"join","user":"bob","online":["alice","bob"],"time":"..."}
+//   {"type":"leave","user":"bob","online":["alice"],"time":"..."}
+//
+// Each connection has two goroutines: the handler reads, writeLoop
+// writes. Outgoing messages wait in a small queue per connection; a
+// client too slow to keep up is disconnected instead of slowing down
+// everyone else. The server pings every chatPingEvery and drops clients
+// that stay silent (no pong) for chatPongWait.
+
+const (
+	chatPongWait  = 60 * time.Second
+	chatPingEvery = 25 * time.Second
+	chatSendQueue = 32 // Messages queued per client before it's dropped
+
+	// Longest chat message, counted like the form's maxlength does: in
+	// UTF-16 code units (an emoji is 2). Each unit is at most 3 bytes of
+	// UTF-8, which sizes the WebSocket frame limit.
+	chatMaxChars   = 1000
+	chatMaxMessage = 3 * chatMaxChars
+)
+
+type chatEvent struct {
+	Type   string    `json:"type"`
+	User   string    `json:"user"`
+	Text   string    `json:"text,omitempty"`
+	Online []string  `json:"online,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+type chatClient struct {
+	ws   *WSConn
+	user string
+	send chan []byte // Encoded events for writeLoop
+
+	once   sync.Once
+	done   chan struct{} // Closed by drop
+	code   int           // Close code and reason for writeLoop to send
+	reason string
+}
+
+// drop asks writeLoop to close the connection; only the first call counts
+func (c *chatClient) drop(code int, reason string) {
+	c.once.Do(func() {
+		c.code, c.reason = code, reason
+		close(c.done)
+	})
+}
+
+// writeLoop sends queued events and pings until the client is dropped
+func (c *chatClient) writeLoop() {
+	ticker := time.NewTicker(chatPingEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case msg := <-c.send:
+			if err := c.ws.WriteText(msg); err != nil {
+				c.drop(wsCloseGoingAway, "")
+			}
+		case <-ticker.C:
+			if err := c.ws.Ping(); err != nil {
+				c.drop(wsCloseGoingAway, "")
+			}
+		case <-c.done:
+			c.ws.Close(c.code, c.reason) // Also ends the handler's ReadMessage
+			return
+		}
+	}
+}
+
+// ChatRoom is the set of connected clients
+type ChatRoom struct {
+	mu      sync.Mutex
+	clients map[*chatClient]struct{}
+	closed  bool
+	wg      sync.WaitGroup // Running writeLoops
+}
+
+func NewChatRoom() *ChatRoom {
+	return &ChatRoom{clients: make(map[*chatClient]struct{})}
+}
+
+// join adds c and announces it; false once the room is closed
+func (room *ChatRoom) join(c *chatClient) bool {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	if room.closed {
+		return false
+	}
+	room.clients[c] = struct{}{}
+	room.wg.Go(c.writeLoop)
+	room.broadcastLocked(chatEvent{Type: "join", User: c.user, Online: room.onlineLocked(), Time: time.Now()})
+	return true
+}
+
+// leave removes c and tells the others
+func (room *ChatRoom) leave(c *chatClient) {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	if _, ok := room.clients[c]; !ok {
+		return
+	}
+	delete(room.clients, c)
+	room.broadcastLocked(chatEvent{Type: "leave", User: c.user, Online: room.onlineLocked(), Time: time.Now()})
+}
+
+func (room *ChatRoom) broadcast(ev chatEvent) {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	room.broadcastLocked(ev)
+}
+
+// broadcastLocked queues ev for every client, dropping the ones whose
+// queue is full
+func (room *ChatRoom) broadcastLocked(ev chatEvent) {
+	msg, err := json.Marshal(ev)
+	if err != nil {
+		log.Printf("chat: %v", err)
+		return
+	}
+	for c := range room.clients {
+		select {
+		case c.send <- msg:
+		default:
+			c.drop(wsClosePolicy, "too slow, messages were piling up")
+		}
+	}
+}
+
+// Usernames of everyone connected, sorted (two tabs count once)
+func (room *ChatRoom) onlineLocked() []string {
+	users := []string{}
+	for c := range room.clients {
+		users = append(users, c.user)
+	}
+	slices.Sort(users)
+	return slices.Compact(users)
+}
+
+// Count returns the number of open connections
+func (room *ChatRoom) Count() int {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	return len(room.clients)
+}
+
+// Close disconnects everyone ("going away") and waits until the close
+// frames are written. The HTTP server's Shutdown doesn't know about
+// hijacked connections, so this runs as a shutdown hook.
+func (room *ChatRoom) Close(ctx context.Context) error {
+	room.mu.Lock()
+	room.closed = true
+	for c := range room.clients {
+		c.drop(wsCloseGoingAway, "server shutting down")
+	}
+	room.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		room.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+var chatRoom = NewChatRoom()
+
+func init() {
+	metrics.NewGaugeFunc("chat_connections", "Open chat WebSocket connections.", func() (float64, bool) {
+		return float64(chatRoom.Count()), true
+	})
+}
+
+// ==========================================
+// HANDLERS
+// ==========================================
+
+func chatPageHandler(w http.ResponseWriter, r *http.Request) {
+	renderer.Render(w, "chat", pageData{Session: currentSession(r), CSRFToken: csrfToken(w, r)})
+}
+
+// GET /chat/ws, behind RequireAuth
+func chatSocketHandler(w http.ResponseWriter, r *http.Request) {
+	session := currentSession(r)
+	ws, err := upgradeWebSocket(w, r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	ws.MaxMessage = chatMaxMessage
+
+	c := &chatClient{ws: ws, user: session.Username, send: make(chan []byte, chatSendQueue), done: make(chan struct{})}
+	if !chatRoom.join(c) {
+		ws.Close(wsCloseGoingAway, "server shutting down")
+		return
+	}
+	defer chatRoom.leave(c)
+
+	// A pong (or any message) proves the client is still there
+	ws.SetReadDeadline(time.Now().Add(chatPongWait))
+	ws.OnPong = func() { ws.SetReadDeadline(time.Now().Add(chatPongWait)) }
+
+	for {
+		opcode, data, err := ws.ReadMessage()
+		if err != nil {
+			var closeErr *WSCloseError
+			if errors.As(err, &closeErr) {
+				c.drop(closeErr.Code, "")
+			} else {
+				c.drop(wsCloseGoingAway, "") // Timeout or broken connection
+			}
+			return
+		}
+		ws.SetReadDeadline(time.Now().Add(chatPongWait))
+		if opcode != wsText {
+			c.drop(wsCloseUnsupported, "send text messages")
+			return
+		}
+		if utf16Len(string(data)) > chatMaxChars {
+			c.drop(wsCloseTooBig, fmt.Sprintf("messages are limited to %d characters", chatMaxChars))
+			return
+		}
+		text := strings.TrimSpace(string(data))
+		if text == "" {
+			continue
+		}
+		chatRoom.broadcast(chatEvent{Type: "message", User: c.user, Text: text, Time: time.Now()})
+	}
+}
+
+// utf16Len is the length of s as JavaScript (and maxlength) counts it
+func utf16Len(s string) int {
+	n := 0
+	for _, r := range s {
+		n += utf16.RuneLen(r)
+	}
+	return n
+}
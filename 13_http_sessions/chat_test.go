@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+// Chat messages are limited in the units the browser's maxlength counts
+func TestUTF16Len(t *testing.T) {
+	tests := []struct {
+		s    string
+		want int
+	}{
+		{"", 0},
+		{"hello", 5},
+		{"héllo", 5}, // 2 bytes in UTF-8, 1 unit
+		{"日本", 2},    // 3 bytes each, 1 unit
+		{"😀", 2},     // Outside the BMP: a surrogate pair
+		{"a👍🏽b", 6},  // Emoji plus skin tone modifier: two pairs
+		{"\xff", 1},  // Invalid byte: U+FFFD
+	}
+	for _, tt := range tests {
+		if got := utf16Len(tt.s); got != tt.want {
+			t.Errorf("utf16Len(%q) = %d, want %d", tt.s, got, tt.want)
+		}
+	}
+}
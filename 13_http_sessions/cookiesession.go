@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ==========================================
+// STATELESS COOKIE SESSIONS
+// ==========================================
+// Instead of keeping sessions on the server, the whole Session is put
+// in the cookie itself:
+//
+//   <version>.<key id>.<payload>.<signature>
+//
+// version   = "v1" when signed only, "v1e" when also encrypted
+// payload   = base64(JSON), or base64(nonce + AES-GCM(JSON)) for "v1e"
+// signature = base64(HMAC-SHA256 over "<version>.<key id>.<payload>")
+//
+// The version says how the payload was written, so cookies issued before
+// -cookie-encrypt was switched on or off can still be read.
+//
+// Every server instance that shares the keys can read the cookie, so no
+// shared store is needed behind a load balancer. The trade-off: a cookie
+// can't be revoked before it expires.
+
+const (
+	cookieFormatSigned    = "v1"
+	cookieFormatEncrypted = "v1e"
+)
+
+// Browsers reject cookies larger than about 4KB
+const maxCookieSize = 4096
+
+var (
+	ErrCookieMalformed  = errors.New("session cookie: malformed")
+	ErrCookieUnknownKey = errors.New("session cookie: unknown key id")
+	ErrCookieSignature  = errors.New("session cookie: bad signature")
+	ErrCookieTooLarge   = errors.New("session cookie: too large")
+)
+
+// One key, identified by a short ID so old cookies can still be checked
+// after the signing key is rotated
+type cookieKey struct {
+	id     string
+	macKey []byte
+	encKey []byte
+}
+
+// CookieCodec turns a Session into a cookie value and back
+type CookieCodec struct {
+	signing cookieKey            // Used for new cookies
+	keys    map[string]cookieKey // Accepted when reading (includes signing)
+	encrypt bool
+}
+
+// NewCookieCodec builds a codec from secrets written as "kid:base64secret".
+// The first secret signs new cookies, all of them are accepted when reading.
+// To rotate: put the new key first, keep the old one after it until every
+// cookie signed with it has expired, then remove it.
+func NewCookieCodec(secrets []string, encrypt bool) (*CookieCodec, error) {
+	if len(secrets) == 0 {
+		return nil, errors.New("cookie sessions need at least one key")
+	}
+
+	c := &CookieCodec{keys: make(map[string]cookieKey), encrypt: encrypt}
+	for i, s := range secrets {
+		id, encoded, ok := strings.Cut(strings.TrimSpace(s), ":")
+		if !ok || id == "" || strings.Contains(id, ".") {
+			return nil, fmt.Errorf("cookie key %d: want \"kid:base64secret\"", i+1)
+		}
+		secret, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("cookie key %q: %w", id, err)
+		}
+		if len(secret) < 32 {
+			return nil, fmt.Errorf("cookie key %q: need at least 32 bytes", id)
+		}
+		if _, dup := c.keys[id]; dup {
+			return nil, fmt.Errorf("cookie key %q: duplicate id", id)
+		}
+
+		key := cookieKey{
+			id:     id,
+			macKey: deriveKey(secret, "session-mac"),
+			encKey: deriveKey(secret, "session-enc"),
+		}
+		c.keys[id] = key
+		if i == 0 {
+			c.signing = key
+		}
+	}
+	return c, nil
+}
+
+// Separate sub-keys for signing and encrypting, from one secret
+func deriveKey(secret []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// Random key in the "kid:base64secret" format, handy for development
+func generateCookieSecret(id string) string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return id + ":" + base64.StdEncoding.EncodeToString(b)
+}
+
+// Encode serializes, optionally encrypts, and signs a session
+func (c *CookieCodec) Encode(session *Session) (string, error) {
+	payload, err := json.Marshal(session)
+	if err != nil {
+		return "", err
+	}
+
+	version := cookieFormatSigned
+	if c.encrypt {
+		payload, err = sealCookie(c.signing, payload)
+		if err != nil {
+			return "", err
+		}
+		version = cookieFormatEncrypted
+	}
+
+	signed := version + "." + c.signing.id + "." +
+		base64.RawURLEncoding.EncodeToString(payload)
+	value := signed + "." + base64.RawURLEncoding.EncodeToString(signCookie(c.signing, signed))
+
+	if len(value) > maxCookieSize {
+		return "", ErrCookieTooLarge
+	}
+	return value, nil
+}
+
+// Decode checks the signature (with whichever key signed it), decrypts
+// if the version says so, and returns the session
+func (c *CookieCodec) Decode(value string) (*Session, error) {
+	parts := strings.Split(value, ".")
+	if len(parts) != 4 || (parts[0] != cookieFormatSigned && parts[0] != cookieFormatEncrypted) {
+		return nil, ErrCookieMalformed
+	}
+
+	key, ok := c.keys[parts[1]]
+	if !ok {
+		return nil, ErrCookieUnknownKey
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[3])
+	if err != nil {
+		return nil, ErrCookieMalformed
+	}
+	signed := parts[0] + "." + parts[1] + "." + parts[2]
+	if !hmac.Equal(sig, signCookie(key, signed)) { // Constant-time compare
+		return nil, ErrCookieSignature
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrCookieMalformed
+	}
+	if parts[0] == cookieFormatEncrypted {
+		payload, err = openCookie(key, payload)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var session Session
+	if err := json.Unmarshal(payload, &session); err != nil {
+		return nil, ErrCookieMalformed
+	}
+	return &session, nil
+}
+
+func signCookie(key cookieKey, data string) []byte {
+	mac := hmac.New(sha256.New, key.macKey)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// AES-256-GCM encrypt; the random nonce is put in front of the ciphertext.
+// The key ID is passed as additional data, binding the two together.
+func sealCookie(key cookieKey, plaintext []byte) ([]byte, error) {
+	gcm, err := newGCM(key.encKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	rand.Read(nonce)
+	return gcm.Seal(nonce, nonce, plaintext, []byte(key.id)), nil
+}
+
+func openCookie(key cookieKey, data []byte) ([]byte, error) {
+	gcm, err := newGCM(key.encKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, ErrCookieMalformed
+	}
+	nonce, ciphertext := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, []byte(key.id))
+	if err != nil {
+		return nil, fmt.Errorf("session cookie: %w", err)
+	}
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testCookieKey(id string, fill byte) string {
+	return id + ":" + base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string(fill), 32)))
+}
+
+func mustCookieCodec(t *testing.T, encrypt bool, secrets ...string) *CookieCodec {
+	t.Helper()
+	c, err := NewCookieCodec(secrets, encrypt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestCookieCodecRoundTrip(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	in := &Session{
+		Username:   "alice",
+		LoginTime:  now,
+		LastAccess: now,
+		ExpiresAt:  now.Add(time.Hour),
+		Roles:      []string{"admin"},
+		Data:       map[string]string{"theme": "dark"},
+	}
+
+	for _, encrypt := range []bool{false, true} {
+		c := mustCookieCodec(t, encrypt, testCookieKey("k1", 'a'))
+		value, err := c.Encode(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		payload, _ := base64.RawURLEncoding.DecodeString(strings.Split(value, ".")[2])
+		if visible := strings.Contains(string(payload), "alice"); visible == encrypt {
+			t.Errorf("encrypt=%v: username visible = %v", encrypt, visible)
+		}
+		out, err := c.Decode(value)
+		if err != nil {
+			t.Fatalf("encrypt=%v: %v", encrypt, err)
+		}
+		if out.Username != "alice" || out.Data["theme"] != "dark" || !out.ExpiresAt.Equal(in.ExpiresAt) {
+			t.Errorf("encrypt=%v: got %+v", encrypt, out)
+		}
+	}
+}
+
+func TestCookieCodecRejects(t *testing.T) {
+	c := mustCookieCodec(t, false, testCookieKey("k1", 'a'))
+	value, err := c.Encode(&Session{Username: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(value, ".")
+
+	// Same payload, but claiming to be bob
+	forged := base64.RawURLEncoding.EncodeToString([]byte(`{"Username":"bob"}`))
+
+	tests := []struct {
+		name  string
+		value string
+		want  error
+	}{
+		{"tampered payload", parts[0] + "." + parts[1] + "." + forged + "." + parts[3], ErrCookieSignature},
+		{"tampered signature", value[:len(value)-2] + "AA", ErrCookieSignature},
+		{"signature not base64", parts[0] + "." + parts[1] + "." + parts[2] + ".!!", ErrCookieMalformed},
+		{"unknown kid", parts[0] + ".k9." + parts[2] + "." + parts[3], ErrCookieUnknownKey},
+		{"unknown version", "v9." + parts[1] + "." + parts[2] + "." + parts[3], ErrCookieMalformed},
+		{"version swapped", "v1e." + parts[1] + "." + parts[2] + "." + parts[3], ErrCookieSignature},
+		{"too few parts", parts[0] + "." + parts[1], ErrCookieMalformed},
+		{"empty", "", ErrCookieMalformed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := c.Decode(tt.value); !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCookieCodecRotation(t *testing.T) {
+	old := mustCookieCodec(t, false, testCookieKey("k1", 'a'))
+	oldValue, err := old.Encode(&Session{Username: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// New key first, old one kept for reading
+	rotated := mustCookieCodec(t, false, testCookieKey("k2", 'b'), testCookieKey("k1", 'a'))
+	if s, err := rotated.Decode(oldValue); err != nil || s.Username != "alice" {
+		t.Fatalf("old cookie after rotation: %v, %v", s, err)
+	}
+	newValue, err := rotated.Encode(&Session{Username: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(newValue, "v1.k2.") {
+		t.Errorf("new cookie not signed with k2: %q", newValue)
+	}
+
+	// Old key retired
+	retired := mustCookieCodec(t, false, testCookieKey("k2", 'b'))
+	if _, err := retired.Decode(oldValue); !errors.Is(err, ErrCookieUnknownKey) {
+		t.Errorf("retired kid: got %v", err)
+	}
+	if _, err := retired.Decode(newValue); err != nil {
+		t.Errorf("current kid: %v", err)
+	}
+
+	// Same kid, different secret: the signature no longer matches
+	replaced := mustCookieCodec(t, false, testCookieKey("k1", 'z'))
+	if _, err := replaced.Decode(oldValue); !errors.Is(err, ErrCookieSignature) {
+		t.Errorf("replaced secret: got %v", err)
+	}
+}
+
+func TestCookieCodecEncryptToggle(t *testing.T) {
+	key := testCookieKey("k1", 'a')
+	plain := mustCookieCodec(t, false, key)
+	sealed := mustCookieCodec(t, true, key)
+
+	plainValue, _ := plain.Encode(&Session{Username: "alice"})
+	sealedValue, _ := sealed.Encode(&Session{Username: "bob"})
+	if !strings.HasPrefix(sealedValue, "v1e.") {
+		t.Fatalf("encrypted cookie has version %q", strings.SplitN(sealedValue, ".", 2)[0])
+	}
+
+	// Turning -cookie-encrypt on or off keeps existing cookies readable
+	if s, err := sealed.Decode(plainValue); err != nil || s.Username != "alice" {
+		t.Errorf("plain cookie, encrypt on: %v, %v", s, err)
+	}
+	if s, err := plain.Decode(sealedValue); err != nil || s.Username != "bob" {
+		t.Errorf("encrypted cookie, encrypt off: %v, %v", s, err)
+	}
+}
+
+func TestCookieCodecExpiry(t *testing.T) {
+	c := mustCookieCodec(t, true, testCookieKey("k1", 'a'))
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		session Session
+		expired bool
+	}{
+		{"fresh", Session{ExpiresAt: now.Add(time.Hour), LastAccess: now, IdleTimeout: time.Minute}, false},
+		{"absolute timeout", Session{ExpiresAt: now.Add(-time.Second), LastAccess: now}, true},
+		{"idle timeout", Session{ExpiresAt: now.Add(time.Hour), LastAccess: now.Add(-2 * time.Minute), IdleTimeout: time.Minute}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value, err := c.Encode(&tt.session)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Decode doesn't judge timeouts; getSession checks Expired
+			s, err := c.Decode(value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := s.Expired(now); got != tt.expired {
+				t.Errorf("Expired = %v, want %v", got, tt.expired)
+			}
+		})
+	}
+}
+
+func TestCookieCodecSizeLimit(t *testing.T) {
+	c := mustCookieCodec(t, true, testCookieKey("k1", 'a'))
+
+	small := &Session{Data: map[string]string{"note": strings.Repeat("x", 100)}}
+	if _, err := c.Encode(small); err != nil {
+		t.Errorf("small session: %v", err)
+	}
+
+	big := &Session{Data: map[string]string{"note": strings.Repeat("x", maxCookieSize)}}
+	if _, err := c.Encode(big); !errors.Is(err, ErrCookieTooLarge) {
+		t.Errorf("big session: got %v, want ErrCookieTooLarge", err)
+	}
+}
+
+func TestNewCookieCodecErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		secrets []string
+	}{
+		{"no keys", nil},
+		{"no kid", []string{base64.StdEncoding.EncodeToString(make([]byte, 32))}},
+		{"dot in kid", []string{testCookieKey("k.1", 'a')}},
+		{"short secret", []string{"k1:" + base64.StdEncoding.EncodeToString(make([]byte, 16))}},
+		{"bad base64", []string{"k1:not base64!"}},
+		{"duplicate kid", []string{testCookieKey("k1", 'a'), testCookieKey("k1", 'b')}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewCookieCodec(tt.secrets, false); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
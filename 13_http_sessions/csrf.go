@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// ==========================================
+// CSRF PROTECTION
+// ==========================================
+// A malicious site can make your browser POST to /login or /logout here,
+// and the browser happily attaches our cookies. To stop that, every
+// state-changing request must carry a token that only our own pages know.
+//
+// The token is HMAC(server key, session cookie), so it is tied to one
+// session and needs no storage. Visitors without a session get a random
+// "csrf_seed" cookie to tie the token to instead. Logging in rotates the
+// session ID, so pre-login tokens stop working afterwards.
+
+const (
+	csrfFormField = "csrf_token"
+	csrfHeader    = "X-CSRF-Token"
+)
+
+// New key on every start: forms rendered before a restart must be reloaded
+var csrfKey = func() []byte {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return b
+}()
+
+// csrfToken returns the token to embed in forms for this request,
+// issuing a seed cookie to visitors who don't have a session yet
+func csrfToken(w http.ResponseWriter, r *http.Request) string {
+	if token := expectedCSRFToken(r); token != "" {
+		return token
+	}
+
+	seed := generateSessionID()
+	http.SetCookie(w, newCookie(csrfSeedCookieName, seed, 0))
+	return csrfTokenFor(seed)
+}
+
+func csrfTokenFor(binding string) string {
+	mac := hmac.New(sha256.New, csrfKey)
+	mac.Write([]byte(binding))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Token this request should carry, "" if it has nothing to bind to
+func expectedCSRFToken(r *http.Request) string {
+	if cookie, err := r.Cookie(sessionCookieName); err == nil {
+		// In cookie mode the cookie changes whenever the session data
+		// does, so bind to the login itself instead
+		if cookieCodec != nil {
+			if s, err := cookieCodec.Decode(cookie.Value); err == nil {
+				return csrfTokenFor(s.Username + "|" + s.LoginTime.Format(time.RFC3339Nano))
+			}
+		}
+		return csrfTokenFor(cookie.Value)
+	}
+	if cookie, err := r.Cookie(csrfSeedCookieName); err == nil {
+		return csrfTokenFor(cookie.Value)
+	}
+	return ""
+}
+
+// Safe methods don't change anything, so they skip the check
+func isSafeMethod(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return true
+	}
+	return false
+}
+
+// CSRF middleware: checks Origin/Referer and the token on unsafe methods
+func csrfMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Browsers never add a Bearer token on their own, so requests
+		// authenticated by one can't be forged (see tokens.go)
+		if isSafeMethod(r.Method) || bearerAuthenticated(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !sameOrigin(r) {
+			log.Printf("CSRF: cross-origin %s %s rejected", r.Method, r.URL.Path)
+			writeProblem(w, r, &Problem{Type: problemCSRF, Title: "Cross-origin request blocked",
+				Status: http.StatusForbidden, Detail: "This form can only be sent from this site."})
+			return
+		}
+
+		sent := r.Header.Get(csrfHeader)
+		if sent == "" {
+			sent = r.PostFormValue(csrfFormField)
+		}
+		want := expectedCSRFToken(r)
+		if want == "" || !hmac.Equal([]byte(sent), []byte(want)) {
+			log.Printf("CSRF: bad or missing token on %s %s", r.Method, r.URL.Path)
+			writeProblem(w, r, &Problem{Type: problemCSRF, Title: "Invalid CSRF token",
+				Status: http.StatusForbidden, Detail: "Reload the page and try again."})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Browsers send Origin (or at least Referer) on cross-site POSTs.
+// If present, its host must be ours. Non-browser clients often send
+// neither; they still need a valid token.
+func sameOrigin(r *http.Request) bool {
+	source := r.Header.Get("Origin")
+	if source == "" {
+		source = r.Header.Get("Referer")
+	}
+	if source == "" {
+		return true
+	}
+	if source == "null" { // Sandboxed iframes, file:// pages, ...
+		return false
+	}
+	u, err := url.Parse(source)
+	if err != nil {
+		return false
+	}
+	return u.Host == r.Host
+}
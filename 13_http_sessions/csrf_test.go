@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpectedCSRFTokenBinding(t *testing.T) {
+	login := time.Date(2026, 1, 2, 3, 4, 5, 6, time.UTC)
+
+	request := func(cookies ...*http.Cookie) *http.Request {
+		r := httptest.NewRequest("POST", "/logout", nil)
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		return r
+	}
+
+	// Store mode: bound to the session cookie value
+	if got := expectedCSRFToken(request()); got != "" {
+		t.Errorf("no cookies: got %q, want none", got)
+	}
+	byID := expectedCSRFToken(request(&http.Cookie{Name: sessionCookieName, Value: "id-1"}))
+	if byID != csrfTokenFor("id-1") {
+		t.Error("store mode: token not bound to the session ID")
+	}
+	if other := expectedCSRFToken(request(&http.Cookie{Name: sessionCookieName, Value: "id-2"})); other == byID {
+		t.Error("store mode: two sessions share a token")
+	}
+	seeded := expectedCSRFToken(request(&http.Cookie{Name: csrfSeedCookieName, Value: "seed"}))
+	if seeded != csrfTokenFor("seed") {
+		t.Error("no session: token not bound to the seed cookie")
+	}
+
+	// Cookie mode: bound to who logged in and when, so it survives the
+	// cookie being re-encoded on every change
+	codec := mustCookieCodec(t, true, testCookieKey("k1", 'a'))
+	cookieCodec = codec
+	t.Cleanup(func() { cookieCodec = nil })
+
+	encode := func(s *Session) *http.Cookie {
+		value, err := codec.Encode(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &http.Cookie{Name: sessionCookieName, Value: value}
+	}
+	first := encode(&Session{Username: "alice", LoginTime: login})
+	changed := encode(&Session{Username: "alice", LoginTime: login, Data: map[string]string{"theme": "dark"}})
+	relogin := encode(&Session{Username: "alice", LoginTime: login.Add(time.Second)})
+
+	want := csrfTokenFor("alice|" + login.Format(time.RFC3339Nano))
+	if got := expectedCSRFToken(request(first)); got != want {
+		t.Error("cookie mode: token not bound to Username|LoginTime")
+	}
+	if got := expectedCSRFToken(request(changed)); got != want {
+		t.Error("cookie mode: token changed with the session data")
+	}
+	if got := expectedCSRFToken(request(relogin)); got == want {
+		t.Error("cookie mode: token survived a new login")
+	}
+}
+
+func TestSameOrigin(t *testing.T) {
+	tests := []struct {
+		name            string
+		origin, referer string
+		want            bool
+	}{
+		{"neither header", "", "", true},
+		{"same origin", "http://example.test", "", true},
+		{"other origin", "http://evil.test", "", false},
+		{"other port", "http://example.test:8080", "", false},
+		{"null origin", "null", "", false},
+		{"origin wins over referer", "http://evil.test", "http://example.test/form", false},
+		{"referer fallback", "", "http://example.test/form?x=1", true},
+		{"referer other site", "", "http://evil.test/form", false},
+		{"referer unparsable", "", "http://[::1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "http://example.test/login", nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if tt.referer != "" {
+				r.Header.Set("Referer", tt.referer)
+			}
+			if got := sameOrigin(r); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCSRFMiddleware(t *testing.T) {
+	handler := csrfMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	session := &http.Cookie{Name: sessionCookieName, Value: "id-1"}
+	token := csrfTokenFor("id-1")
+
+	tests := []struct {
+		name   string
+		method string
+		body   string // Form-encoded
+		setup  func(r *http.Request)
+		want   int
+	}{
+		{"safe method", "GET", "", func(r *http.Request) {}, http.StatusNoContent},
+		{"no token", "POST", "", func(r *http.Request) { r.AddCookie(session) }, http.StatusForbidden},
+		{"header token", "POST", "", func(r *http.Request) {
+			r.AddCookie(session)
+			r.Header.Set(csrfHeader, token)
+		}, http.StatusNoContent},
+		{"form token", "POST", url.Values{csrfFormField: {token}}.Encode(), func(r *http.Request) {
+			r.AddCookie(session)
+		}, http.StatusNoContent},
+		{"token for another session", "POST", "", func(r *http.Request) {
+			r.AddCookie(session)
+			r.Header.Set(csrfHeader, csrfTokenFor("id-2"))
+		}, http.StatusForbidden},
+		{"good token, cross-origin", "POST", "", func(r *http.Request) {
+			r.AddCookie(session)
+			r.Header.Set(csrfHeader, token)
+			r.Header.Set("Origin", "http://evil.test")
+		}, http.StatusForbidden},
+		{"API token skips the check", "DELETE", "", func(r *http.Request) {
+			*r = *r.WithContext(context.WithValue(r.Context(), apiTokenCtxKey{}, &APIToken{}))
+		}, http.StatusNoContent},
+		{"JWT skips the check", "POST", "", func(r *http.Request) {
+			*r = *r.WithContext(context.WithValue(r.Context(), jwtClaimsCtxKey{}, &JWTClaims{}))
+		}, http.StatusNoContent},
+		{"rejected bearer doesn't skip", "POST", "", func(r *http.Request) {
+			r.AddCookie(session)
+			*r = *r.WithContext(context.WithValue(r.Context(), bearerErrCtxKey{}, &bearerFailure{}))
+		}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "http://example.test/logout", strings.NewReader(tt.body))
+			if tt.body != "" {
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			tt.setup(r)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("got %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
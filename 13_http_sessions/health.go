@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ==========================================
+// HEALTH AND READINESS
+// ==========================================
+//   GET /healthz   liveness: is the process working at all?
+//                  (failing = restart me, so only for what a restart
+//                  fixes, like a deadlock; not for a full disk)
+//   GET /readyz    readiness: should I get traffic right now?
+//                  (failing = route around me, e.g. while shutting down)
+//
+// Both run a set of named checks and answer 200 or 503 with a report:
+//
+//   {"status": "fail", "checks": {
+//     "session_store": {"status": "ok",   "latency_ms": 0.02},
+//     "shutdown":      {"status": "fail", "latency_ms": 0, "error": "server is shutting down"}}}
+
+// Longest a single check may take before it counts as failed
+var healthCheckTimeout = 2 * time.Second
+
+// HealthCheck returns nil when healthy
+type HealthCheck func(ctx context.Context) error
+
+type namedCheck struct {
+	name  string
+	check HealthCheck
+}
+
+// HealthChecks is a registry of checks run together
+type HealthChecks struct {
+	mu     sync.Mutex
+	checks []namedCheck
+}
+
+// Add registers a check; names must be unique
+func (h *HealthChecks) Add(name string, check HealthCheck) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, c := range h.checks {
+		if c.name == name {
+			panic("health: check registered twice: " + name)
+		}
+	}
+	h.checks = append(h.checks, namedCheck{name, check})
+}
+
+type checkResult struct {
+	Status    string  `json:"status"` // "ok" or "fail"
+	LatencyMs float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+type healthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks"`
+}
+
+// Run executes every check in parallel, each with its own timeout
+func (h *HealthChecks) Run(ctx context.Context) healthReport {
+	h.mu.Lock()
+	checks := append([]namedCheck{}, h.checks...)
+	h.mu.Unlock()
+
+	report := healthReport{Status: "ok", Checks: make(map[string]checkResult, len(checks))}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, c := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+			defer cancel()
+
+			start := time.Now()
+			err := runCheck(ctx, c.check)
+			res := checkResult{Status: "ok", LatencyMs: float64(time.Since(start).Microseconds()) / 1000}
+			if err != nil {
+				res.Status, res.Error = "fail", err.Error()
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			report.Checks[c.name] = res
+			if err != nil {
+				report.Status = "fail"
+			}
+		}()
+	}
+	wg.Wait()
+	return report
+}
+
+// Run check, but give up when ctx ends even if check ignores it
+func runCheck(ctx context.Context, check HealthCheck) error {
+	done := make(chan error, 1)
+	go func() { done <- check(ctx) }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("timed out after %v", healthCheckTimeout)
+	}
+}
+
+// Handler answers with the report: 200 if every check passed, else 503
+func (h *HealthChecks) Handler(w http.ResponseWriter, r *http.Request) {
+	report := h.Run(r.Context())
+	status := http.StatusOK
+	if report.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, status, report)
+}
+
+var (
+	liveness  = &HealthChecks{}
+	readiness = &HealthChecks{}
+
+	// Set as soon as shutdown starts, before listeners close (see serve)
+	shuttingDown atomic.Bool
+)
+
+// ==========================================
+// CHECKS
+// ==========================================
+
+// Pinger is implemented by stores that can tell whether they work
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// checkLocks takes the locks every request depends on. A deadlock there
+// leaves the process up but hanging; the check then times out and
+// /healthz fails, so the supervisor restarts us.
+func checkLocks(context.Context) error {
+	store.Get("healthcheck-probe")
+	userStore.GetByID(0)
+	tokenStore.ListByUser(0)
+	loginGuard.Locked(time.Now())
+	return nil
+}
+
+func checkShutdown(context.Context) error {
+	if shuttingDown.Load() {
+		return errors.New("server is shutting down")
+	}
+	return nil
+}
+
+// checkSessionStore pings the store, or looks up a session that can't
+// exist: "not found" still proves the store answers
+func checkSessionStore(ctx context.Context) error {
+	if p, ok := store.(Pinger); ok {
+		return p.Ping(ctx)
+	}
+	_, err := store.Get("healthcheck-probe")
+	if err == nil || errors.Is(err, ErrSessionNotFound) || errors.Is(err, ErrSessionExpired) {
+		return nil
+	}
+	return err
+}
+
+func checkUserStore(ctx context.Context) error {
+	if p, ok := userStore.(Pinger); ok {
+		return p.Ping(ctx)
+	}
+	_, err := userStore.List()
+	return err
+}
+
+func checkTokenStore(ctx context.Context) error {
+	return tokenStore.Ping(ctx)
+}
+
+// canReplace proves the stores could still save path. They never write
+// to path itself: they write a temp file next to it and rename that over
+// path. So what must be writable is the directory, and path, if it
+// exists, must be a file a rename can replace.
+func canReplace(path string) error {
+	if info, err := os.Stat(path); err == nil && !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", path)
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), ".healthcheck-*")
+	if err != nil {
+		return fmt.Errorf("cannot write to %s: %w", filepath.Dir(path), err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// Ping reports whether the session file can still be saved
+func (f *FileStore) Ping(context.Context) error {
+	return canReplace(f.path)
+}
+
+// Ping reports whether the users file can still be saved
+func (s *FileUserStore) Ping(context.Context) error {
+	if s.path == "" {
+		return nil
+	}
+	return canReplace(s.path)
+}
+
+// Ping reports whether the tokens file can still be saved
+func (s *FileTokenStore) Ping(context.Context) error {
+	if s.path == "" {
+		return nil
+	}
+	return canReplace(s.path)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHealthHandler(t *testing.T) {
+	saved := healthCheckTimeout
+	healthCheckTimeout = 100 * time.Millisecond
+	t.Cleanup(func() { healthCheckTimeout = saved })
+
+	ok := func(context.Context) error { return nil }
+	failing := func(context.Context) error { return errors.New("disk on fire") }
+	hanging := func(context.Context) error { select {} } // Ignores ctx
+
+	tests := []struct {
+		name   string
+		checks map[string]HealthCheck
+		status int
+		failed map[string]string // Check name -> error
+	}{
+		{"no checks", nil, 200, nil},
+		{"all pass", map[string]HealthCheck{"a": ok, "b": ok}, 200, nil},
+		{"one fails", map[string]HealthCheck{"a": ok, "b": failing}, 503, map[string]string{"b": "disk on fire"}},
+		{"one hangs", map[string]HealthCheck{"a": ok, "slow": hanging}, 503, map[string]string{"slow": "timed out after 100ms"}},
+		{"hang and fail", map[string]HealthCheck{"slow": hanging, "b": failing}, 503,
+			map[string]string{"slow": "timed out after 100ms", "b": "disk on fire"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &HealthChecks{}
+			for name, check := range tt.checks {
+				h.Add(name, check)
+			}
+
+			start := time.Now()
+			w := httptest.NewRecorder()
+			h.Handler(w, httptest.NewRequest("GET", "/healthz", nil))
+			// Checks run in parallel: one timeout, not one per check
+			if took := time.Since(start); took > time.Second {
+				t.Errorf("took %v", took)
+			}
+
+			if w.Code != tt.status {
+				t.Errorf("status %d, want %d", w.Code, tt.status)
+			}
+			if w.Header().Get("Cache-Control") != "no-store" {
+				t.Error("health answers must not be cached")
+			}
+			var report healthReport
+			if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+				t.Fatal(err)
+			}
+			if len(report.Checks) != len(tt.checks) {
+				t.Errorf("report has %d checks, want %d", len(report.Checks), len(tt.checks))
+			}
+			for name, res := range report.Checks {
+				want, shouldFail := tt.failed[name]
+				if shouldFail && (res.Status != "fail" || res.Error != want) {
+					t.Errorf("%s: %+v, want error %q", name, res, want)
+				}
+				if !shouldFail && res.Status != "ok" {
+					t.Errorf("%s: %+v", name, res)
+				}
+			}
+		})
+	}
+}
+
+func TestHealthChecksRejectDuplicates(t *testing.T) {
+	h := &HealthChecks{}
+	h.Add("a", checkShutdown)
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic")
+		}
+	}()
+	h.Add("a", checkShutdown)
+}
+
+// A stuck lock must fail liveness so the process gets restarted
+func TestCheckLocksFailsOnDeadlock(t *testing.T) {
+	saved := healthCheckTimeout
+	healthCheckTimeout = 100 * time.Millisecond
+	t.Cleanup(func() { healthCheckTimeout = saved })
+	usersAPI(t) // Fresh stores
+
+	h := &HealthChecks{}
+	h.Add("locks", checkLocks)
+	if report := h.Run(context.Background()); report.Status != "ok" {
+		t.Fatalf("healthy process: %+v", report)
+	}
+
+	loginGuard.mu.Lock()
+	report := h.Run(context.Background())
+	loginGuard.mu.Unlock()
+	if report.Status != "fail" {
+		t.Errorf("held lock: %+v", report)
+	}
+}
+
+func TestCanReplace(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "users.json")
+
+	if err := canReplace(path); err != nil {
+		t.Errorf("file not created yet: %v", err)
+	}
+
+	// Saving renames over the file, so a read-only file is no obstacle...
+	os.WriteFile(path, []byte("{}"), 0o444)
+	if err := canReplace(path); err != nil {
+		t.Errorf("read-only file in a writable directory: %v", err)
+	}
+	users, _ := NewFileUserStore(path)
+	if err := users.Create(&User{Username: "alice"}); err != nil {
+		t.Errorf("saving over a read-only file: %v", err)
+	}
+
+	// ...but a directory in its place is
+	os.Remove(path)
+	os.Mkdir(path, 0o755)
+	if err := canReplace(path); err == nil {
+		t.Error("directory at the file's path passed")
+	}
+
+	if os.Getuid() == 0 {
+		t.Skip("root can write to read-only directories")
+	}
+	readOnly := filepath.Join(dir, "ro")
+	os.Mkdir(readOnly, 0o555)
+	if err := canReplace(filepath.Join(readOnly, "users.json")); err == nil {
+		t.Error("read-only directory passed")
+	}
+}
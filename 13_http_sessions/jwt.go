@@ -0,0 +1,591 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ==========================================
+// JSON WEB TOKENS
+// ==========================================
+// In a project with a go.mod this would be its own package (jwt). The
+// lesson is a single package main built with "go build *.go", so it lives
+// in this file, standard library only, and jwtauth.go uses it.
+//
+// A JWT is three base64url parts joined by dots:
+//
+//   header      {"alg":"EdDSA","kid":"20261017T120000-1a2b3c","typ":"at+jwt"}
+//   payload     {"iss":"...","sub":"1","aud":"...","exp":1760000900,...}
+//   signature   over "header.payload", made with the key named by kid
+//
+// Anyone can read a JWT; the signature only proves we wrote it. The
+// algorithm always comes from our key, never from the token, so a token
+// claiming "alg":"none" (or HS256 with our RSA public key as the secret)
+// is rejected.
+//
+// Supported algorithms:
+//
+//   HS256   HMAC-SHA256 with a shared secret, never published
+//   RS256   RSA PKCS#1 v1.5 with SHA-256
+//   EdDSA   Ed25519, small keys and signatures (the default)
+//
+// RS256 and EdDSA public keys are published at /.well-known/jwks.json so
+// other services can verify our tokens without sharing a secret.
+
+const (
+	algHS256 = "HS256"
+	algRS256 = "RS256"
+	algEdDSA = "EdDSA"
+)
+
+var (
+	ErrJWTMalformed   = errors.New("malformed token")
+	ErrJWTUnknownKey  = errors.New("unknown signing key")
+	ErrJWTSignature   = errors.New("bad signature")
+	ErrJWTType        = errors.New("wrong token type")
+	ErrJWTExpired     = errors.New("token expired")
+	ErrJWTNotYetValid = errors.New("token not valid yet")
+	ErrJWTIssuer      = errors.New("wrong issuer")
+	ErrJWTAudience    = errors.New("wrong audience")
+)
+
+// ==========================================
+// CLAIMS
+// ==========================================
+
+// JWTClaims are the registered claims we check, plus our own
+type JWTClaims struct {
+	Issuer    string   `json:"iss,omitempty"`
+	Subject   string   `json:"sub,omitempty"` // User ID
+	Audience  audience `json:"aud,omitempty"`
+	ExpiresAt int64    `json:"exp,omitempty"` // Unix seconds, like nbf and iat
+	NotBefore int64    `json:"nbf,omitempty"`
+	IssuedAt  int64    `json:"iat,omitempty"`
+	ID        string   `json:"jti,omitempty"`
+
+	Username    string   `json:"username,omitempty"`
+	Roles       []string `json:"roles,omitempty"`
+	Permissions []string `json:"perms,omitempty"`
+	Family      string   `json:"fam,omitempty"` // Refresh tokens: the login they belong to
+}
+
+// audience is "aud": a single string or a list of them
+type audience []string
+
+func (a audience) MarshalJSON() ([]byte, error) {
+	if len(a) == 1 {
+		return json.Marshal(a[0])
+	}
+	return json.Marshal([]string(a))
+}
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*a = audience{one}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(a))
+}
+
+// Validate checks the time window, issuer and audience. leeway allows for
+// clocks that are a little off between us and other servers.
+func (c *JWTClaims) Validate(now time.Time, issuer, aud string, leeway time.Duration) error {
+	switch {
+	case c.ExpiresAt == 0:
+		return ErrJWTMalformed // We never issue tokens that don't expire
+	case !now.Before(time.Unix(c.ExpiresAt, 0).Add(leeway)):
+		return ErrJWTExpired
+	case c.NotBefore != 0 && now.Add(leeway).Before(time.Unix(c.NotBefore, 0)):
+		return ErrJWTNotYetValid
+	case c.IssuedAt != 0 && now.Add(leeway).Before(time.Unix(c.IssuedAt, 0)):
+		return ErrJWTNotYetValid
+	case c.Issuer != issuer:
+		return ErrJWTIssuer
+	case !slices.Contains(c.Audience, aud):
+		return ErrJWTAudience
+	}
+	return nil
+}
+
+// ==========================================
+// KEYS
+// ==========================================
+
+// JWTKey is one signing key, named by its kid
+type JWTKey struct {
+	ID      string
+	Alg     string
+	Created time.Time
+
+	secret  []byte        // HS256
+	private crypto.Signer // RS256 (*rsa.PrivateKey), EdDSA (ed25519.PrivateKey)
+}
+
+func newJWTKey(alg string, now time.Time) (*JWTKey, error) {
+	suffix := make([]byte, 3)
+	rand.Read(suffix)
+	k := &JWTKey{
+		ID:      now.UTC().Format("20060102T150405") + "-" + hex.EncodeToString(suffix),
+		Alg:     alg,
+		Created: now,
+	}
+	switch alg {
+	case algHS256:
+		k.secret = make([]byte, 32)
+		rand.Read(k.secret)
+	case algRS256:
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, err
+		}
+		k.private = key
+	case algEdDSA:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		k.private = key
+	default:
+		return nil, fmt.Errorf("unknown JWT algorithm %q (want %s, %s or %s)", alg, algHS256, algRS256, algEdDSA)
+	}
+	return k, nil
+}
+
+func (k *JWTKey) sign(input []byte) ([]byte, error) {
+	switch k.Alg {
+	case algHS256:
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write(input)
+		return mac.Sum(nil), nil
+	case algRS256:
+		digest := sha256.Sum256(input)
+		return k.private.Sign(rand.Reader, digest[:], crypto.SHA256)
+	default: // EdDSA signs the message itself, not a hash
+		return k.private.Sign(rand.Reader, input, crypto.Hash(0))
+	}
+}
+
+func (k *JWTKey) verify(input, sig []byte) bool {
+	switch k.Alg {
+	case algHS256:
+		want, _ := k.sign(input)
+		return hmac.Equal(sig, want)
+	case algRS256:
+		digest := sha256.Sum256(input)
+		return rsa.VerifyPKCS1v15(&k.private.(*rsa.PrivateKey).PublicKey, crypto.SHA256, digest[:], sig) == nil
+	default:
+		return ed25519.Verify(k.private.Public().(ed25519.PublicKey), input, sig)
+	}
+}
+
+// jwk is the public half as a JSON Web Key; false for HS256, whose
+// secret must never leave the server
+func (k *JWTKey) jwk() (map[string]string, bool) {
+	b64 := base64.RawURLEncoding.EncodeToString
+	switch k.Alg {
+	case algRS256:
+		pub := k.private.(*rsa.PrivateKey).PublicKey
+		return map[string]string{"kty": "RSA", "use": "sig", "alg": k.Alg, "kid": k.ID,
+			"n": b64(pub.N.Bytes()), "e": b64(big.NewInt(int64(pub.E)).Bytes())}, true
+	case algEdDSA:
+		return map[string]string{"kty": "OKP", "crv": "Ed25519", "use": "sig", "alg": k.Alg, "kid": k.ID,
+			"x": b64(k.private.Public().(ed25519.PublicKey))}, true
+	}
+	return nil, false
+}
+
+// Keys are saved as PEM, with kid, alg and creation time in the headers
+const hmacPEMType = "JWT HMAC SECRET"
+
+func (k *JWTKey) marshalPEM() ([]byte, error) {
+	block := &pem.Block{
+		Type:    "PRIVATE KEY",
+		Headers: map[string]string{"Kid": k.ID, "Alg": k.Alg, "Created": k.Created.UTC().Format(time.RFC3339)},
+	}
+	if k.Alg == algHS256 {
+		block.Type, block.Bytes = hmacPEMType, k.secret
+	} else {
+		der, err := x509.MarshalPKCS8PrivateKey(k.private)
+		if err != nil {
+			return nil, err
+		}
+		block.Bytes = der
+	}
+	return pem.EncodeToMemory(block), nil
+}
+
+func parseJWTKeyPEM(data []byte) (*JWTKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block")
+	}
+	created, err := time.Parse(time.RFC3339, block.Headers["Created"])
+	if err != nil {
+		return nil, fmt.Errorf("bad Created header: %w", err)
+	}
+	k := &JWTKey{ID: block.Headers["Kid"], Alg: block.Headers["Alg"], Created: created}
+	if k.ID == "" {
+		return nil, errors.New("missing Kid header")
+	}
+
+	if block.Type == hmacPEMType {
+		k.secret = block.Bytes
+	} else {
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		k.private, _ = key.(crypto.Signer)
+	}
+	// The alg header must match the kind of key in the file
+	switch {
+	case k.Alg == algHS256 && len(k.secret) >= 32:
+	case k.Alg == algRS256 && isType[*rsa.PrivateKey](k.private):
+	case k.Alg == algEdDSA && isType[ed25519.PrivateKey](k.private):
+	default:
+		return nil, fmt.Errorf("key %s: %s key doesn't match alg %q", k.ID, block.Type, k.Alg)
+	}
+	return k, nil
+}
+
+func isType[T any](v any) bool {
+	_, ok := v.(T)
+	return ok
+}
+
+// ==========================================
+// KEY SET AND ROTATION
+// ==========================================
+// The newest key signs; older ones only verify, until every token they
+// signed has expired (Retain after they stopped signing). Rotating is
+// just adding a key: clients look up the kid, so nothing breaks.
+//
+// Other services cache our JWKS for up to jwksMaxAge, so a new key is
+// published first and only signs after jwtSignDelay: that cache time,
+// plus one rotation check for the servers sharing the directory to load
+// it. Until then the previous key keeps signing, and every verifier has
+// the new key before the first token naming it arrives. (On the very
+// first start there is no previous key and the new one signs right away.)
+//
+// With a directory the keys survive restarts and can be shared by
+// several servers: each one reads the directory again on every rotation
+// check (and when a token names a kid it hasn't seen), so a key made by
+// one server is loaded by all of them before any signs with it.
+// Without a directory the keys are made fresh on every start.
+
+// Least time between two reloads caused by unknown kids, so tokens with
+// made-up kids can't keep us busy reading the directory
+const jwtReloadGap = 10 * time.Second
+
+const (
+	jwksMaxAge       = 5 * time.Minute // How long verifiers may cache /.well-known/jwks.json
+	jwtRotationCheck = time.Minute     // How often startRotation runs rotateIfDue
+	jwtSignDelay     = jwksMaxAge + jwtRotationCheck
+)
+
+type JWTKeySet struct {
+	Alg         string        // For new keys
+	RotateEvery time.Duration // Age at which the signing key is replaced
+	Retain      time.Duration // How long a replaced key still verifies
+
+	dir        string
+	mu         sync.RWMutex
+	keys       map[string]*JWTKey
+	newest     *JWTKey   // Signs from newest.Created + jwtSignDelay
+	reloadedAt time.Time // Last read of dir caused by an unknown kid
+}
+
+// NewJWTKeySet loads the keys in dir ("" = memory only) and makes a
+// signing key if there's no fresh one
+func NewJWTKeySet(alg, dir string, rotateEvery, retain time.Duration) (*JWTKeySet, error) {
+	ks := &JWTKeySet{Alg: alg, RotateEvery: rotateEvery, Retain: retain, dir: dir, keys: make(map[string]*JWTKey)}
+	if err := ks.loadLocked(); err != nil { // Nobody else has ks yet
+		return nil, err
+	}
+	if err := ks.rotateIfDue(time.Now()); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+// loadLocked adds the keys in dir it doesn't have yet. A file that can't be read is reported but
+// doesn't stop the others loading. Caller holds the write lock.
+func (ks *JWTKeySet) loadLocked() error {
+	if ks.dir == "" {
+		return nil
+	}
+	files, err := filepath.Glob(filepath.Join(ks.dir, "*.pem"))
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, file := range files {
+		if _, ok := ks.keys[strings.TrimSuffix(filepath.Base(file), ".pem")]; ok {
+			continue
+		}
+		data, err := os.ReadFile(file)
+		if errors.Is(err, os.ErrNotExist) {
+			continue // Retired by another server meanwhile
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		k, err := parseJWTKeyPEM(data)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", file, err))
+			continue
+		}
+		ks.keys[k.ID] = k
+		if ks.newest == nil || k.Created.After(ks.newest.Created) {
+			ks.newest = k
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// signerLocked is the key that signs at now: the newest one verifiers
+// have had jwtSignDelay to fetch. If none has been around that long,
+// the oldest key, which has been signing since the start. Caller holds
+// a lock.
+func (ks *JWTKeySet) signerLocked(now time.Time) *JWTKey {
+	var signer, oldest *JWTKey
+	for _, k := range ks.keys {
+		published := !now.Before(k.Created.Add(jwtSignDelay))
+		if published && (signer == nil || k.Created.After(signer.Created)) {
+			signer = k
+		}
+		if oldest == nil || k.Created.Before(oldest.Created) {
+			oldest = k
+		}
+	}
+	if signer == nil {
+		return oldest
+	}
+	return signer
+}
+
+// reloadFor reads dir again for a kid we don't know, at most once every
+// jwtReloadGap
+func (ks *JWTKeySet) reloadFor(kid string) (*JWTKey, bool) {
+	if ks.dir == "" {
+		return nil, false
+	}
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	if k, ok := ks.keys[kid]; ok { // Loaded by a request racing with us
+		return k, true
+	}
+	now := time.Now()
+	if now.Sub(ks.reloadedAt) < jwtReloadGap {
+		return nil, false
+	}
+	ks.reloadedAt = now
+	if err := ks.loadLocked(); err != nil {
+		log.Printf("JWT: reading keys: %v", err)
+	}
+	k, ok := ks.keys[kid]
+	return k, ok
+}
+
+// rotateIfDue picks up keys other servers made, makes a new key when the
+// newest one is too old or uses another algorithm, and forgets keys no
+// token can still need
+func (ks *JWTKeySet) rotateIfDue(now time.Time) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if err := ks.loadLocked(); err != nil {
+		log.Printf("JWT: reading keys: %v", err) // Keep going with the keys we have
+	}
+	if n := ks.newest; n == nil || n.Alg != ks.Alg || (ks.RotateEvery > 0 && now.Sub(n.Created) >= ks.RotateEvery) {
+		k, err := newJWTKey(ks.Alg, now)
+		if err != nil {
+			return err
+		}
+		if err := ks.save(k); err != nil {
+			return err
+		}
+		ks.keys[k.ID] = k
+		ks.newest = k
+		from := k.Created.Add(jwtSignDelay)
+		if ks.signerLocked(now) == k {
+			from = now
+		}
+		log.Printf("JWT: published new %s key %s, signing with it from %s", k.Alg, k.ID, from.Format(time.RFC3339))
+	}
+
+	// A key stopped signing when the next one took over
+	byAge := slices.SortedFunc(maps.Values(ks.keys), func(a, b *JWTKey) int { return a.Created.Compare(b.Created) })
+	for i, k := range byAge[:len(byAge)-1] {
+		if retired := byAge[i+1].Created.Add(jwtSignDelay); now.Sub(retired) > ks.Retain {
+			delete(ks.keys, k.ID)
+			if ks.dir != "" {
+				os.Remove(filepath.Join(ks.dir, k.ID+".pem"))
+			}
+			log.Printf("JWT: dropped retired key %s", k.ID)
+		}
+	}
+	return nil
+}
+
+func (ks *JWTKeySet) save(k *JWTKey) error {
+	if ks.dir == "" {
+		return nil
+	}
+	data, err := k.marshalPEM()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(ks.dir, 0o700); err != nil {
+		return err
+	}
+
+	// Temp file and rename, so other servers never read half a key.
+	// The name doesn't end in .pem until it's complete.
+	tmp, err := os.CreateTemp(ks.dir, ".key-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(ks.dir, k.ID+".pem"))
+}
+
+// startRotation checks every jwtRotationCheck whether a new key is due
+func (ks *JWTKeySet) startRotation(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(jwtRotationCheck)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				if err := ks.rotateIfDue(now); err != nil {
+					log.Printf("JWT: key rotation: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// ==========================================
+// SIGN AND VERIFY
+// ==========================================
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	Typ string `json:"typ,omitempty"`
+}
+
+// Sign encodes claims as a JWT of type typ, signed by the current key
+func (ks *JWTKeySet) Sign(typ string, claims any) (string, error) {
+	ks.mu.RLock()
+	k := ks.signerLocked(time.Now())
+	ks.mu.RUnlock()
+
+	header, err := json.Marshal(jwtHeader{Alg: k.Alg, Kid: k.ID, Typ: typ})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	b64 := base64.RawURLEncoding.EncodeToString
+	input := b64(header) + "." + b64(payload)
+	sig, err := k.sign([]byte(input))
+	if err != nil {
+		return "", err
+	}
+	return input + "." + b64(sig), nil
+}
+
+// Verify checks the signature and type of token and decodes its payload
+// into claims. The claims still need validating (see JWTClaims.Validate).
+func (ks *JWTKeySet) Verify(token, typ string, claims any) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ErrJWTMalformed
+	}
+	b64 := base64.RawURLEncoding.DecodeString
+	rawHeader, err1 := b64(parts[0])
+	payload, err2 := b64(parts[1])
+	sig, err3 := b64(parts[2])
+	var header jwtHeader
+	if err := errors.Join(err1, err2, err3); err != nil || json.Unmarshal(rawHeader, &header) != nil {
+		return ErrJWTMalformed
+	}
+
+	ks.mu.RLock()
+	k, ok := ks.keys[header.Kid]
+	ks.mu.RUnlock()
+	if !ok {
+		k, ok = ks.reloadFor(header.Kid) // Maybe another server's new key
+	}
+	if !ok {
+		return ErrJWTUnknownKey
+	}
+	if header.Alg != k.Alg || !k.verify([]byte(parts[0]+"."+parts[1]), sig) {
+		return ErrJWTSignature
+	}
+	// Checked after the signature: the typ stops a refresh token being
+	// used as an access token and the other way round
+	if header.Typ != typ {
+		return ErrJWTType
+	}
+	if err := json.Unmarshal(payload, claims); err != nil {
+		return ErrJWTMalformed
+	}
+	return nil
+}
+
+// GET /.well-known/jwks.json
+func (ks *JWTKeySet) JWKSHandler(w http.ResponseWriter, r *http.Request) {
+	ks.mu.RLock()
+	keys := []map[string]string{}
+	for _, k := range ks.keys {
+		if jwk, ok := k.jwk(); ok {
+			keys = append(keys, jwk)
+		}
+	}
+	ks.mu.RUnlock()
+	slices.SortFunc(keys, func(a, b map[string]string) int { return strings.Compare(b["kid"], a["kid"]) })
+
+	// Verifiers may cache this for jwksMaxAge: new keys are published
+	// longer than that before they sign
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(jwksMaxAge.Seconds())))
+	writeJSON(w, http.StatusOK, map[string]any{"keys": keys})
+}
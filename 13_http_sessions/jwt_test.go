@@ -0,0 +1,368 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestKeySet(t *testing.T, alg string) *JWTKeySet {
+	t.Helper()
+	ks, err := NewJWTKeySet(alg, "", 0, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ks
+}
+
+// forgeJWT builds a token by hand, with any header and signature
+func forgeJWT(header, payload any, sign func(input []byte) []byte) string {
+	h, _ := json.Marshal(header)
+	p, _ := json.Marshal(payload)
+	b64 := base64.RawURLEncoding.EncodeToString
+	input := b64(h) + "." + b64(p)
+	return input + "." + b64(sign([]byte(input)))
+}
+
+func TestJWTVerify(t *testing.T) {
+	ks := newTestKeySet(t, algEdDSA)
+	other := newTestKeySet(t, algEdDSA)
+	key := ks.newest
+	claims := JWTClaims{Subject: "1", ExpiresAt: time.Now().Add(time.Hour).Unix()}
+	sign := func(typ string) string {
+		token, err := ks.Sign(typ, claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	access := sign(jwtTypeAccess)
+	parts := strings.Split(access, ".")
+	hmacWith := func(secret []byte) func([]byte) []byte {
+		return func(input []byte) []byte {
+			mac := hmac.New(sha256.New, secret)
+			mac.Write(input)
+			return mac.Sum(nil)
+		}
+	}
+	public, _ := key.jwk()
+
+	tests := []struct {
+		name  string
+		token string
+		typ   string
+		want  error
+	}{
+		{"access", access, jwtTypeAccess, nil},
+		{"refresh", sign(jwtTypeRefresh), jwtTypeRefresh, nil},
+		{"refresh as access", sign(jwtTypeRefresh), jwtTypeAccess, ErrJWTType},
+		{"access as refresh", access, jwtTypeRefresh, ErrJWTType},
+		{"no typ", forgeJWT(jwtHeader{Alg: algEdDSA, Kid: key.ID}, claims, func(in []byte) []byte {
+			sig, _ := key.sign(in)
+			return sig
+		}), jwtTypeAccess, ErrJWTType},
+
+		// The algorithm is the key's, whatever the header says
+		{"alg none", forgeJWT(jwtHeader{Alg: "none", Kid: key.ID, Typ: jwtTypeAccess}, claims,
+			func([]byte) []byte { return nil }), jwtTypeAccess, ErrJWTSignature},
+		{"HS256 with the public key", forgeJWT(jwtHeader{Alg: algHS256, Kid: key.ID, Typ: jwtTypeAccess}, claims,
+			hmacWith([]byte(public["x"]))), jwtTypeAccess, ErrJWTSignature},
+		{"right alg, other key", forgeJWT(jwtHeader{Alg: algEdDSA, Kid: key.ID, Typ: jwtTypeAccess}, claims,
+			func(in []byte) []byte {
+				sig, _ := other.newest.sign(in)
+				return sig
+			}), jwtTypeAccess, ErrJWTSignature},
+		{"unknown kid", forgeJWT(jwtHeader{Alg: algEdDSA, Kid: "nope", Typ: jwtTypeAccess}, claims,
+			func([]byte) []byte { return nil }), jwtTypeAccess, ErrJWTUnknownKey},
+		{"another set's token", func() string {
+			token, _ := other.Sign(jwtTypeAccess, claims)
+			return token
+		}(), jwtTypeAccess, ErrJWTUnknownKey},
+
+		{"payload swapped", parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"2"}`)) + "." + parts[2],
+			jwtTypeAccess, ErrJWTSignature},
+		{"signature dropped", parts[0] + "." + parts[1] + ".", jwtTypeAccess, ErrJWTSignature},
+		{"two parts", parts[0] + "." + parts[1], jwtTypeAccess, ErrJWTMalformed},
+		{"bad base64", parts[0] + ".!!." + parts[2], jwtTypeAccess, ErrJWTMalformed},
+		{"empty", "", jwtTypeAccess, ErrJWTMalformed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got JWTClaims
+			err := ks.Verify(tt.token, tt.typ, &got)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			if err == nil && got.Subject != "1" {
+				t.Errorf("claims %+v", got)
+			}
+		})
+	}
+}
+
+func TestJWTClaimsValidate(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	leeway := 30 * time.Second
+	at := func(d time.Duration) int64 { return now.Add(d).Unix() }
+	valid := func(edit func(c *JWTClaims)) JWTClaims {
+		c := JWTClaims{Issuer: "us", Audience: audience{"app"}, ExpiresAt: at(time.Minute), NotBefore: at(0), IssuedAt: at(0)}
+		edit(&c)
+		return c
+	}
+
+	tests := []struct {
+		name   string
+		claims JWTClaims
+		want   error
+	}{
+		{"valid", valid(func(c *JWTClaims) {}), nil},
+		{"expired within leeway", valid(func(c *JWTClaims) { c.ExpiresAt = at(-29 * time.Second) }), nil},
+		{"expired at the leeway", valid(func(c *JWTClaims) { c.ExpiresAt = at(-30 * time.Second) }), ErrJWTExpired},
+		{"expired long ago", valid(func(c *JWTClaims) { c.ExpiresAt = at(-time.Hour) }), ErrJWTExpired},
+		{"no exp", valid(func(c *JWTClaims) { c.ExpiresAt = 0 }), ErrJWTMalformed},
+		{"nbf within leeway", valid(func(c *JWTClaims) { c.NotBefore = at(30 * time.Second) }), nil},
+		{"nbf past leeway", valid(func(c *JWTClaims) { c.NotBefore = at(31 * time.Second) }), ErrJWTNotYetValid},
+		{"iat in the future", valid(func(c *JWTClaims) { c.IssuedAt = at(time.Minute) }), ErrJWTNotYetValid},
+		{"other issuer", valid(func(c *JWTClaims) { c.Issuer = "them" }), ErrJWTIssuer},
+		{"other audience", valid(func(c *JWTClaims) { c.Audience = audience{"other"} }), ErrJWTAudience},
+		{"audience list", valid(func(c *JWTClaims) { c.Audience = audience{"other", "app"} }), nil},
+		{"no audience", valid(func(c *JWTClaims) { c.Audience = nil }), ErrJWTAudience},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.claims.Validate(now, "us", "app", leeway); !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestAudienceJSON(t *testing.T) {
+	for _, tt := range []struct {
+		aud  audience
+		json string
+	}{
+		{audience{"a"}, `"a"`},
+		{audience{"a", "b"}, `["a","b"]`},
+	} {
+		data, _ := json.Marshal(tt.aud)
+		if string(data) != tt.json {
+			t.Errorf("%v encodes as %s", tt.aud, data)
+		}
+		var back audience
+		if err := json.Unmarshal(data, &back); err != nil || !slices.Equal(back, tt.aud) {
+			t.Errorf("%s decodes as %v, %v", data, back, err)
+		}
+	}
+}
+
+// newTestIssuer gives a JWTIssuer and a fresh user store holding alice
+func newTestIssuer(t *testing.T) (*JWTIssuer, *User) {
+	t.Helper()
+	usersAPI(t) // Fresh stores
+	alice := &User{Username: "alice", Roles: []string{roleAdmin}}
+	if err := userStore.Create(alice); err != nil {
+		t.Fatal(err)
+	}
+	j := NewJWTIssuer()
+	j.Keys = newTestKeySet(t, algEdDSA)
+	return j, alice
+}
+
+func TestJWTRefresh(t *testing.T) {
+	j, alice := newTestIssuer(t)
+	r := httptest.NewRequest("POST", "/api/auth/refresh", nil)
+	now := time.Now()
+
+	first, err := j.login(alice, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := j.refresh(r, first.AccessToken, now); !errors.Is(err, ErrJWTType) {
+		t.Errorf("access token as refresh token: %v", err)
+	}
+
+	// A refresh reads the user again
+	userStore.Modify(alice.ID, func(u *User) error {
+		u.Roles = []string{roleMember}
+		return nil
+	})
+	second, err := j.refresh(r, first.RefreshToken, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, _, err := j.sessionFor(second.AccessToken, now)
+	if err != nil || !slices.Equal(session.Roles, []string{roleMember}) {
+		t.Errorf("after refresh: %+v, %v", session, err)
+	}
+
+	// Using the first refresh token again revokes the whole family,
+	// including the token the legitimate holder got
+	if _, err := j.refresh(r, first.RefreshToken, now); !errors.Is(err, ErrRefreshReused) {
+		t.Errorf("reuse: %v", err)
+	}
+	if _, err := j.refresh(r, second.RefreshToken, now); !errors.Is(err, ErrRefreshRevoked) {
+		t.Errorf("after reuse: %v", err)
+	}
+
+	// Refresh tokens run out, and logout ends the family
+	third, _ := j.login(alice, now)
+	if _, err := j.refresh(r, third.RefreshToken, now.Add(j.RefreshTTL+j.Leeway)); !errors.Is(err, ErrJWTExpired) {
+		t.Errorf("expired: %v", err)
+	}
+	if err := j.logout(third.RefreshToken, now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := j.refresh(r, third.RefreshToken, now); !errors.Is(err, ErrRefreshRevoked) {
+		t.Errorf("after logout: %v", err)
+	}
+
+	// A deleted user can't refresh
+	fourth, _ := j.login(alice, now)
+	userStore.Delete(alice.ID)
+	if _, err := j.refresh(r, fourth.RefreshToken, now); !errors.Is(err, ErrRefreshRevoked) {
+		t.Errorf("deleted user: %v", err)
+	}
+}
+
+func TestJWTRevokeUser(t *testing.T) {
+	j, alice := newTestIssuer(t)
+	bob := &User{Username: "bob", Roles: []string{roleMember}}
+	if err := userStore.Create(bob); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("POST", "/api/auth/refresh", nil)
+	now := time.Now()
+
+	phone, _ := j.login(alice, now)
+	laptop, _ := j.login(alice, now)
+	bobs, _ := j.login(bob, now)
+
+	if n := j.revokeUser(alice.ID); n != 2 {
+		t.Errorf("revoked %d families, want 2", n)
+	}
+	for _, tokens := range []*tokenResponse{phone, laptop} {
+		if _, err := j.refresh(r, tokens.RefreshToken, now); !errors.Is(err, ErrRefreshRevoked) {
+			t.Errorf("alice: %v", err)
+		}
+	}
+	if _, err := j.refresh(r, bobs.RefreshToken, now); err != nil {
+		t.Errorf("bob: %v", err)
+	}
+	// Access tokens can't be revoked: they run until they expire
+	if _, _, err := j.sessionFor(phone.AccessToken, now); err != nil {
+		t.Errorf("alice's access token: %v", err)
+	}
+	if n := j.revokeUser(alice.ID); n != 0 {
+		t.Errorf("revoked %d again", n)
+	}
+}
+
+// A new key is in the JWKS for jwtSignDelay before anything is signed
+// with it, and a replaced key verifies for Retain after that
+func TestJWTKeyRotation(t *testing.T) {
+	dir := t.TempDir()
+	a, err := NewJWTKeySet(algEdDSA, dir, time.Hour, 10*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := a.newest
+	if a.signerLocked(first.Created) != first {
+		t.Fatal("the only key doesn't sign")
+	}
+
+	rotated := first.Created.Add(time.Hour)
+	if err := a.rotateIfDue(rotated); err != nil {
+		t.Fatal(err)
+	}
+	second := a.newest
+	if second == first {
+		t.Fatal("no new key")
+	}
+
+	// Another server sharing the directory loads it on its next check
+	b, err := NewJWTKeySet(algEdDSA, dir, time.Hour, 10*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.newest.ID != second.ID || len(b.keys) != 2 {
+		t.Errorf("second server has %d keys, newest %s", len(b.keys), b.newest.ID)
+	}
+
+	w := httptest.NewRecorder()
+	a.JWKSHandler(w, httptest.NewRequest("GET", "/.well-known/jwks.json", nil))
+	if got := w.Header().Get("Cache-Control"); got != "public, max-age=300" {
+		t.Errorf("Cache-Control: %q", got)
+	}
+	var jwks struct{ Keys []map[string]string }
+	json.Unmarshal(w.Body.Bytes(), &jwks)
+	if len(jwks.Keys) != 2 || jwks.Keys[0]["kid"] != second.ID {
+		t.Errorf("JWKS %+v", jwks.Keys)
+	}
+
+	for _, step := range []struct {
+		at   time.Duration // After the rotation
+		want *JWTKey
+	}{
+		{0, first},
+		{jwksMaxAge, first}, // A verifier may just have cached the old JWKS
+		{jwtSignDelay - time.Second, first},
+		{jwtSignDelay, second},
+		{2 * jwtSignDelay, second},
+	} {
+		if got := a.signerLocked(rotated.Add(step.at)); got != step.want {
+			t.Errorf("%v after rotating: signed by %s", step.at, got.ID)
+		}
+		if got := b.signerLocked(rotated.Add(step.at)); got.ID != step.want.ID {
+			t.Errorf("%v after rotating: second server signs with %s", step.at, got.ID)
+		}
+	}
+
+	// The first key stopped signing at rotated+jwtSignDelay, and tokens it
+	// signed then live for Retain
+	stopped := rotated.Add(jwtSignDelay)
+	a.rotateIfDue(stopped.Add(10 * time.Minute))
+	if _, ok := a.keys[first.ID]; !ok {
+		t.Error("first key dropped while its tokens may still be valid")
+	}
+	a.rotateIfDue(stopped.Add(10*time.Minute + time.Second))
+	if _, ok := a.keys[first.ID]; ok || a.newest != second || len(a.keys) != 1 {
+		t.Errorf("first key kept: %d keys", len(a.keys))
+	}
+}
+
+// Switching algorithms is a rotation too: the old key signs until the new
+// one is published, and HS256 secrets never are
+func TestJWTKeyAlgorithmChange(t *testing.T) {
+	dir := t.TempDir()
+	old, err := NewJWTKeySet(algEdDSA, dir, 0, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks, err := NewJWTKeySet(algHS256, dir, 0, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ks.newest.Alg != algHS256 || len(ks.keys) != 2 {
+		t.Fatalf("newest %s, %d keys", ks.newest.Alg, len(ks.keys))
+	}
+	if got := ks.signerLocked(time.Now()); got.ID != old.newest.ID {
+		t.Errorf("signing with %s before the new key is published", got.Alg)
+	}
+	if got := ks.signerLocked(ks.newest.Created.Add(jwtSignDelay)); got != ks.newest {
+		t.Errorf("still signing with %s", got.Alg)
+	}
+
+	w := httptest.NewRecorder()
+	ks.JWKSHandler(w, httptest.NewRequest("GET", "/.well-known/jwks.json", nil))
+	if strings.Contains(w.Body.String(), ks.newest.ID) || !strings.Contains(w.Body.String(), old.newest.ID) {
+		t.Errorf("JWKS: %s", w.Body)
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ==========================================
+// JWT LOGIN (FOR THE SPA)
+// ==========================================
+//   POST /api/auth/login     {"username":"...","password":"..."}  -> tokens
+//   POST /api/auth/refresh   {"refresh_token":"..."}               -> new tokens
+//   POST /api/auth/logout    {"refresh_token":"..."}               -> 204
+//   GET  /.well-known/jwks.json                                     public keys
+//
+// The access token goes in "Authorization: Bearer" on /api/* and is
+// checked by bearerAuth from its signature alone: no session lookup, so
+// it keeps working across restarts and on every server sharing the keys.
+// It is short-lived because it can't be revoked.
+//
+// Refresh tokens are single-use. A login starts a "family", and the
+// server remembers which refresh token of the family is the current one.
+// Using an older one means two parties hold the family's tokens (one of
+// them copied it): the whole family is revoked and both must log in again.
+//
+// Like the lockout records, families are kept in memory: after a restart
+// the SPA has to log in again once its access token runs out.
+//
+// These endpoints need no CSRF token: nothing is sent automatically by the
+// browser (no cookies), and another site can't read the tokens we return.
+
+var (
+	ErrRefreshReused  = errors.New("refresh token was already used")
+	ErrRefreshRevoked = errors.New("login was revoked or has expired")
+)
+
+// Token types in the JWT header, so one kind can't stand in for the other
+const (
+	jwtTypeAccess  = "at+jwt"
+	jwtTypeRefresh = "rt+jwt"
+)
+
+type refreshFamily struct {
+	userID  int
+	current string    // jti of the only refresh token that may be used
+	expires time.Time // When the current refresh token expires
+}
+
+// JWTIssuer hands out and checks the SPA's tokens; fields are set from
+// flags in main()
+type JWTIssuer struct {
+	Issuer     string
+	Audience   string
+	AccessTTL  time.Duration
+	RefreshTTL time.Duration
+	Leeway     time.Duration // Clock skew allowed on exp, nbf and iat
+	Keys       *JWTKeySet
+
+	mu       sync.Mutex
+	families map[string]*refreshFamily
+}
+
+func NewJWTIssuer() *JWTIssuer {
+	return &JWTIssuer{
+		Issuer:     "go-http-session-demo",
+		Audience:   "go-http-session-demo",
+		AccessTTL:  15 * time.Minute,
+		RefreshTTL: 7 * 24 * time.Hour,
+		Leeway:     30 * time.Second,
+		families:   make(map[string]*refreshFamily),
+	}
+}
+
+// Token endpoint response, shaped like OAuth 2.0 (RFC 6749)
+type tokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	TokenType        string `json:"token_type"`
+	ExpiresIn        int    `json:"expires_in"` // Seconds
+	RefreshToken     string `json:"refresh_token"`
+	RefreshExpiresIn int    `json:"refresh_expires_in"`
+}
+
+func randomID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// issue signs a new access/refresh pair for user in family and returns
+// the refresh token's jti; the caller records it as the family's current
+func (j *JWTIssuer) issue(user *User, family string, now time.Time) (*tokenResponse, string, error) {
+	access := JWTClaims{
+		Issuer:      j.Issuer,
+		Subject:     strconv.Itoa(user.ID),
+		Audience:    audience{j.Audience},
+		ExpiresAt:   now.Add(j.AccessTTL).Unix(),
+		NotBefore:   now.Unix(),
+		IssuedAt:    now.Unix(),
+		ID:          randomID(),
+		Username:    user.Username,
+		Roles:       user.Roles,
+		Permissions: effectivePermissions(user.Roles, user.Permissions),
+	}
+	refresh := JWTClaims{
+		Issuer:    j.Issuer,
+		Subject:   strconv.Itoa(user.ID),
+		Audience:  audience{j.Audience},
+		ExpiresAt: now.Add(j.RefreshTTL).Unix(),
+		IssuedAt:  now.Unix(),
+		ID:        randomID(),
+		Family:    family,
+	}
+
+	accessToken, err := j.Keys.Sign(jwtTypeAccess, access)
+	if err != nil {
+		return nil, "", err
+	}
+	refreshToken, err := j.Keys.Sign(jwtTypeRefresh, refresh)
+	if err != nil {
+		return nil, "", err
+	}
+	return &tokenResponse{
+		AccessToken:      accessToken,
+		TokenType:        "Bearer",
+		ExpiresIn:        int(j.AccessTTL.Seconds()),
+		RefreshToken:     refreshToken,
+		RefreshExpiresIn: int(j.RefreshTTL.Seconds()),
+	}, refresh.ID, nil
+}
+
+// login starts a new family for user
+func (j *JWTIssuer) login(user *User, now time.Time) (*tokenResponse, error) {
+	family := randomID()
+	tokens, jti, err := j.issue(user, family, now)
+	if err != nil {
+		return nil, err
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.families[family] = &refreshFamily{userID: user.ID, current: jti, expires: now.Add(j.RefreshTTL)}
+	return tokens, nil
+}
+
+// verify checks a token of type typ: signature, time window, issuer,
+// audience
+func (j *JWTIssuer) verify(token, typ string, now time.Time) (*JWTClaims, error) {
+	var claims JWTClaims
+	if err := j.Keys.Verify(token, typ, &claims); err != nil {
+		return nil, err
+	}
+	if err := claims.Validate(now, j.Issuer, j.Audience, j.Leeway); err != nil {
+		return nil, err
+	}
+	return &claims, nil
+}
+
+// sessionFor turns an access token into the Session bearerAuth stores
+// for currentSession. Roles and permissions are the ones from login (or
+// the last refresh).
+func (j *JWTIssuer) sessionFor(token string, now time.Time) (*Session, *JWTClaims, error) {
+	claims, err := j.verify(token, jwtTypeAccess, now)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &Session{
+		Username:    claims.Username,
+		LoginTime:   time.Unix(claims.IssuedAt, 0),
+		LastAccess:  now,
+		ExpiresAt:   time.Unix(claims.ExpiresAt, 0),
+		Roles:       claims.Roles,
+		Permissions: claims.Permissions,
+	}, claims, nil
+}
+
+// refresh spends a refresh token and issues the next pair. The user is
+// read again, so role changes and deleted accounts take effect here.
+func (j *JWTIssuer) refresh(r *http.Request, token string, now time.Time) (*tokenResponse, error) {
+	claims, err := j.verify(token, jwtTypeRefresh, now)
+	if err != nil {
+		return nil, err
+	}
+
+	j.mu.Lock()
+	fam, ok := j.families[claims.Family]
+	switch {
+	case !ok || now.After(fam.expires):
+		j.mu.Unlock()
+		return nil, ErrRefreshRevoked
+	case fam.current != claims.ID:
+		delete(j.families, claims.Family)
+		j.mu.Unlock()
+		auditLog.LogAttrs(r.Context(), slog.LevelWarn, "refresh token reuse",
+			slog.String("user_id", claims.Subject),
+			slog.String("family", claims.Family),
+			slog.String("remote", clientIP(r)),
+			slog.String("request_id", requestID(r)),
+		)
+		return nil, ErrRefreshReused
+	}
+	fam.current = "" // Spent: a second request with this token is a reuse
+	j.mu.Unlock()
+
+	user, err := userStore.GetByID(fam.userID)
+	if err != nil {
+		j.revokeFamily(claims.Family)
+		return nil, ErrRefreshRevoked
+	}
+	tokens, jti, err := j.issue(user, claims.Family, now)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only hand out the new pair if the family wasn't revoked meanwhile
+	// (by a reuse racing with us, or a logout)
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.families[claims.Family] != fam {
+		return nil, ErrRefreshRevoked
+	}
+	fam.current = jti
+	fam.expires = now.Add(j.RefreshTTL)
+	return tokens, nil
+}
+
+// logout ends the login a refresh token belongs to
+func (j *JWTIssuer) logout(token string, now time.Time) error {
+	claims, err := j.verify(token, jwtTypeRefresh, now)
+	if err != nil {
+		return err
+	}
+	j.revokeFamily(claims.Family)
+	return nil
+}
+
+func (j *JWTIssuer) revokeFamily(family string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	delete(j.families, family)
+}
+
+// revokeUser ends all of userID's logins, for when the account is deleted.
+// Access tokens already handed out still work until they expire.
+func (j *JWTIssuer) revokeUser(userID int) int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	removed := 0
+	for id, fam := range j.families {
+		if fam.userID == userID {
+			delete(j.families, id)
+			removed++
+		}
+	}
+	return removed
+}
+
+// startJanitor forgets families whose refresh token has expired
+func (j *JWTIssuer) startJanitor(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				j.mu.Lock()
+				for id, fam := range j.families {
+					if now.After(fam.expires) {
+						delete(j.families, id)
+					}
+				}
+				j.mu.Unlock()
+			}
+		}
+	}()
+}
+
+// ==========================================
+// HANDLERS
+// ==========================================
+
+func writeTokens(w http.ResponseWriter, tokens *tokenResponse) {
+	w.Header().Set("Cache-Control", "no-store") // RFC 6749: never cache tokens
+	writeJSON(w, http.StatusOK, tokens)
+}
+
+func jwtLoginHandler(w http.ResponseWriter, r *http.Request) {
+	var in struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := readJSON(w, r, &in); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	user := attemptLogin(w, r, in.Username, in.Password)
+	if user == nil {
+		return // attemptLogin answered
+	}
+	tokens, err := jwtIssuer.login(user, time.Now())
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeTokens(w, tokens)
+}
+
+// Read {"refresh_token": "..."}; false if the request was answered
+func readRefreshToken(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var in struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := readJSON(w, r, &in); err != nil {
+		writeError(w, r, err)
+		return "", false
+	}
+	if in.RefreshToken == "" {
+		writeProblem(w, r, validationProblem(FieldErrors{"refresh_token": "is required"}))
+		return "", false
+	}
+	return in.RefreshToken, true
+}
+
+func jwtRefreshHandler(w http.ResponseWriter, r *http.Request) {
+	token, ok := readRefreshToken(w, r)
+	if !ok {
+		return
+	}
+	tokens, err := jwtIssuer.refresh(r, token, time.Now())
+	if err != nil {
+		writeProblem(w, r, NewProblem(http.StatusUnauthorized, "Refresh token rejected: "+err.Error()+". Log in again."))
+		return
+	}
+	writeTokens(w, tokens)
+}
+
+func jwtLogoutHandler(w http.ResponseWriter, r *http.Request) {
+	token, ok := readRefreshToken(w, r)
+	if !ok {
+		return
+	}
+	if err := jwtIssuer.logout(token, time.Now()); err != nil {
+		writeProblem(w, r, NewProblem(http.StatusUnauthorized, "Refresh token rejected: "+err.Error()+"."))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"cmp"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ==========================================
+// LIST ENDPOINTS: PAGINATION, SORTING, FILTERING
+// ==========================================
+// Any list endpoint can get these query parameters by describing its
+// fields in a ListSpec and using listHandler:
+//
+//   ?limit=20                 page size
+//   ?cursor=...               continue after the previous page
+//   ?sort=name,-id            sort keys, "-" for descending
+//   ?filter[email]=a@b.c      exact match on a field (case-insensitive;
+//                             RFC 3339 for times, like created_at)
+//   ?q=ali                    free-text search
+//
+// The response is an envelope plus a Link header pointing at the next page:
+//
+//   {"data": [...], "next_cursor": "eyJ...", "limit": 20}
+//
+// Cursors hold the sort values of the last item shown, so pages stay
+// correct while items are added or removed (unlike ?page=N).
+
+// ListSpec describes how items of type T can be listed
+type ListSpec[T any] struct {
+	// Fields usable in sort= and filter[...]. A getter returns a string,
+	// an int or a time.Time.
+	Fields map[string]func(T) any
+	// Unique field used as the final sort key, so the order is total
+	IDField string
+	// Sort used when the client doesn't ask for one
+	DefaultSort string
+	// Matches an item against ?q=, nil disables search
+	Search func(item T, q string) bool
+
+	DefaultLimit int
+	MaxLimit     int
+}
+
+type sortKey struct {
+	field string
+	desc  bool
+}
+
+// ListQuery is a parsed and validated set of list parameters
+type ListQuery struct {
+	Limit   int
+	Sort    []sortKey
+	Filters map[string]string
+	Q       string
+	after   []any // Sort values of the last item on the previous page
+}
+
+// Cursor contents, base64(JSON) on the wire
+type listCursor struct {
+	Sort   string `json:"s"`
+	Values []any  `json:"v"`
+}
+
+// ParseQuery reads and checks the list parameters, naming every bad one
+func (spec *ListSpec[T]) ParseQuery(r *http.Request) (ListQuery, FieldErrors) {
+	errs := FieldErrors{}
+	query := r.URL.Query()
+	q := ListQuery{Limit: spec.DefaultLimit, Filters: map[string]string{}, Q: strings.TrimSpace(query.Get("q"))}
+
+	if s := query.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > spec.MaxLimit {
+			errs["limit"] = fmt.Sprintf("must be a number between 1 and %d", spec.MaxLimit)
+		}
+		q.Limit = n
+	}
+
+	sortParam := query.Get("sort")
+	if sortParam == "" {
+		sortParam = spec.DefaultSort
+	}
+	seen := map[string]bool{}
+	for _, part := range strings.Split(sortParam, ",") {
+		part = strings.TrimSpace(part)
+		key := sortKey{field: strings.TrimPrefix(part, "-"), desc: strings.HasPrefix(part, "-")}
+		if _, ok := spec.Fields[key.field]; !ok {
+			errs["sort"] = fmt.Sprintf("unknown field %q (allowed: %s)", key.field, spec.fieldNames())
+			continue
+		}
+		if !seen[key.field] {
+			seen[key.field] = true
+			q.Sort = append(q.Sort, key)
+		}
+	}
+	if !seen[spec.IDField] { // Tie-breaker: items with equal names still get a fixed order
+		q.Sort = append(q.Sort, sortKey{field: spec.IDField})
+	}
+
+	for param, values := range query {
+		if !strings.HasPrefix(param, "filter[") || !strings.HasSuffix(param, "]") {
+			continue
+		}
+		field := param[len("filter[") : len(param)-1]
+		if _, ok := spec.Fields[field]; !ok {
+			errs[param] = fmt.Sprintf("unknown field %q (allowed: %s)", field, spec.fieldNames())
+			continue
+		}
+		q.Filters[field] = values[0]
+	}
+
+	if q.Q != "" && spec.Search == nil {
+		errs["q"] = "search is not supported here"
+	}
+
+	if c := query.Get("cursor"); c != "" && len(errs) == 0 {
+		after, err := decodeCursor(c, q.sortString(), len(q.Sort))
+		if err != nil {
+			errs["cursor"] = err.Error()
+		}
+		q.after = after
+	}
+
+	if len(errs) > 0 {
+		return q, errs
+	}
+	return q, nil
+}
+
+// Apply filters, sorts and cuts one page out of items.
+// next is the cursor for the following page, "" on the last one.
+// errs names filters whose value doesn't fit the field's type.
+func (spec *ListSpec[T]) Apply(items []T, q ListQuery) (page []T, next string, errs FieldErrors) {
+	if len(items) == 0 {
+		return nil, "", nil
+	}
+	filters, errs := spec.parseFilters(items[0], q.Filters)
+	if errs != nil {
+		return nil, "", errs
+	}
+
+	matched := make([]T, 0, len(items))
+	for _, item := range items {
+		if spec.matches(item, filters, q.Q) {
+			matched = append(matched, item)
+		}
+	}
+
+	sort.SliceStable(matched, func(i, j int) bool {
+		return compareKeys(spec.keyValues(matched[i], q.Sort), spec.keyValues(matched[j], q.Sort), q.Sort) < 0
+	})
+
+	start := 0
+	if q.after != nil {
+		start = sort.Search(len(matched), func(i int) bool {
+			return compareKeys(spec.keyValues(matched[i], q.Sort), q.after, q.Sort) > 0
+		})
+	}
+	end := min(start+q.Limit, len(matched))
+	page = matched[start:end]
+
+	if end < len(matched) && len(page) > 0 {
+		next = encodeCursor(q.sortString(), spec.keyValues(page[len(page)-1], q.Sort))
+	}
+	return page, next, nil
+}
+
+// parseFilters turns filter values into the normalized form of their
+// field, whose type is only known from an item (sample)
+func (spec *ListSpec[T]) parseFilters(sample T, raw map[string]string) (map[string]any, FieldErrors) {
+	errs := FieldErrors{}
+	filters := make(map[string]any, len(raw))
+	for field, want := range raw {
+		param := "filter[" + field + "]"
+		switch spec.Fields[field](sample).(type) {
+		case int, int64:
+			n, err := strconv.ParseInt(want, 10, 64)
+			if err != nil {
+				errs[param] = "must be a whole number"
+			}
+			filters[field] = n
+		case time.Time:
+			t, err := time.Parse(time.RFC3339Nano, want)
+			if err != nil {
+				errs[param] = "must be an RFC 3339 time, like 2006-01-02T15:04:05Z"
+			}
+			filters[field] = normalizeSortValue(t)
+		default:
+			filters[field] = normalizeSortValue(want)
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return filters, nil
+}
+
+func (spec *ListSpec[T]) matches(item T, filters map[string]any, q string) bool {
+	for field, want := range filters {
+		if normalizeSortValue(spec.Fields[field](item)) != want {
+			return false
+		}
+	}
+	if q != "" && !spec.Search(item, q) {
+		return false
+	}
+	return true
+}
+
+// Sort values of item, in sort-key order
+func (spec *ListSpec[T]) keyValues(item T, keys []sortKey) []any {
+	values := make([]any, len(keys))
+	for i, k := range keys {
+		values[i] = normalizeSortValue(spec.Fields[k.field](item))
+	}
+	return values
+}
+
+func (spec *ListSpec[T]) fieldNames() string {
+	names := make([]string, 0, len(spec.Fields))
+	for name := range spec.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// "name,-id" form of the sort keys, stored in cursors
+func (q ListQuery) sortString() string {
+	parts := make([]string, len(q.Sort))
+	for i, k := range q.Sort {
+		parts[i] = k.field
+		if k.desc {
+			parts[i] = "-" + k.field
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// Reduce field values to string or int64 so they compare and survive JSON
+func normalizeSortValue(v any) any {
+	switch v := v.(type) {
+	case string:
+		return strings.ToLower(v)
+	case int:
+		return int64(v)
+	case int64:
+		return v
+	case time.Time:
+		return v.UnixNano()
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// Compare two rows of sort values, honouring descending keys
+func compareKeys(a, b []any, keys []sortKey) int {
+	for i, k := range keys {
+		c := 0
+		switch av := a[i].(type) {
+		case int64:
+			bv, _ := b[i].(int64)
+			c = cmp.Compare(av, bv)
+		case string:
+			bv, _ := b[i].(string)
+			c = cmp.Compare(av, bv)
+		}
+		if k.desc {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+func encodeCursor(sortString string, values []any) string {
+	data, _ := json.Marshal(listCursor{Sort: sortString, Values: values})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(s, sortString string, keys int) ([]any, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("is not a valid cursor")
+	}
+	var c listCursor
+	dec := json.NewDecoder(strings.NewReader(string(data)))
+	dec.UseNumber() // Keep numbers exact, not float64
+	if err := dec.Decode(&c); err != nil {
+		return nil, fmt.Errorf("is not a valid cursor")
+	}
+	if c.Sort != sortString {
+		return nil, fmt.Errorf("was made for sort=%s, not sort=%s", c.Sort, sortString)
+	}
+	if len(c.Values) != keys {
+		return nil, fmt.Errorf("is not a valid cursor")
+	}
+	for i, v := range c.Values {
+		if n, ok := v.(json.Number); ok {
+			c.Values[i], err = n.Int64()
+			if err != nil {
+				return nil, fmt.Errorf("is not a valid cursor")
+			}
+		}
+	}
+	return c.Values, nil
+}
+
+// ==========================================
+// GENERIC LIST HANDLER
+// ==========================================
+
+// listPage is the response envelope
+type listPage[V any] struct {
+	Data       []V     `json:"data"`
+	NextCursor *string `json:"next_cursor"` // null on the last page
+	Limit      int     `json:"limit"`
+}
+
+// listHandler builds a GET handler from a spec, a loader for all items
+// and a function turning an item into its JSON view
+func listHandler[T, V any](spec *ListSpec[T], load func(r *http.Request) ([]T, error), view func(T) V) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q, errs := spec.ParseQuery(r)
+		if errs != nil {
+			writeProblem(w, r, validationProblem(errs))
+			return
+		}
+
+		items, err := load(r)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		page, next, errs := spec.Apply(items, q)
+		if errs != nil {
+			writeProblem(w, r, validationProblem(errs))
+			return
+		}
+		out := listPage[V]{Data: make([]V, 0, len(page)), Limit: q.Limit}
+		for _, item := range page {
+			out.Data = append(out.Data, view(item))
+		}
+
+		links := []string{fmt.Sprintf(`<%s>; rel="first"`, pageURL(r, ""))}
+		if next != "" {
+			out.NextCursor = &next
+			links = append(links, fmt.Sprintf(`<%s>; rel="next"`, pageURL(r, next)))
+		}
+		w.Header().Set("Link", strings.Join(links, ", "))
+		writeJSON(w, http.StatusOK, out)
+	}
+}
+
+// Same URL as the request with the cursor swapped (or removed)
+func pageURL(r *http.Request, cursor string) string {
+	query := r.URL.Query()
+	query.Del("cursor")
+	if cursor != "" {
+		query.Set("cursor", cursor)
+	}
+	u := url.URL{Path: r.URL.Path, RawQuery: query.Encode()}
+	return u.String()
+}
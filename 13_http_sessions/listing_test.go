@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+type listItem struct {
+	ID      int
+	Name    string
+	Created time.Time
+}
+
+var listBase = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+var testListSpec = &ListSpec[listItem]{
+	Fields: map[string]func(listItem) any{
+		"id":      func(it listItem) any { return it.ID },
+		"name":    func(it listItem) any { return it.Name },
+		"created": func(it listItem) any { return it.Created },
+	},
+	IDField:     "id",
+	DefaultSort: "id",
+	Search: func(it listItem, q string) bool {
+		return strings.Contains(strings.ToLower(it.Name), strings.ToLower(q))
+	},
+	DefaultLimit: 3,
+	MaxLimit:     5,
+}
+
+// Ten items, many sharing a name, so only the id tie-breaker orders them
+func testListItems() []listItem {
+	names := []string{"bob", "alice", "bob", "Carol", "alice", "bob", "dave", "alice", "bob", "carol"}
+	items := make([]listItem, len(names))
+	for i, name := range names {
+		items[i] = listItem{ID: i + 1, Name: name, Created: listBase.Add(time.Duration(i%3) * time.Hour)}
+	}
+	return items
+}
+
+func parseListQuery(t *testing.T, rawQuery string) (ListQuery, FieldErrors) {
+	t.Helper()
+	return testListSpec.ParseQuery(httptest.NewRequest("GET", "/items?"+rawQuery, nil))
+}
+
+func ids(items []listItem) []int {
+	out := make([]int, len(items))
+	for i, it := range items {
+		out[i] = it.ID
+	}
+	return out
+}
+
+// allPages follows cursors from the first page to the last
+func allPages(t *testing.T, items []listItem, rawQuery string) [][]int {
+	t.Helper()
+	var pages [][]int
+	cursor := ""
+	for range 20 {
+		query := rawQuery
+		if cursor != "" {
+			query += "&cursor=" + cursor
+		}
+		q, errs := parseListQuery(t, query)
+		if errs != nil {
+			t.Fatalf("%s: %v", query, errs)
+		}
+		page, next, errs := testListSpec.Apply(items, q)
+		if errs != nil {
+			t.Fatalf("%s: %v", query, errs)
+		}
+		pages = append(pages, ids(page))
+		if next == "" {
+			return pages
+		}
+		cursor = next
+	}
+	t.Fatal("cursors never reached the last page")
+	return nil
+}
+
+func TestListPagination(t *testing.T) {
+	items := testListItems()
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"", "[[1 2 3] [4 5 6] [7 8 9] [10]]"},
+		{"limit=5", "[[1 2 3 4 5] [6 7 8 9 10]]"},
+		{"sort=-id&limit=4", "[[10 9 8 7] [6 5 4 3] [2 1]]"},
+		// Equal names are ordered by id, and no item is shown twice or skipped
+		{"sort=name", "[[2 5 8] [1 3 6] [9 4 10] [7]]"},
+		{"sort=-name", "[[7 4 10] [1 3 6] [9 2 5] [8]]"},
+		{"sort=created,-id&limit=4", "[[10 7 4 1] [8 5 2 9] [6 3]]"},
+		{"filter[name]=BOB&limit=2", "[[1 3] [6 9]]"},
+		{"q=aL", "[[2 5 8]]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			pages := allPages(t, items, tt.query)
+			if got := fmt.Sprint(pages); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// Cursors hold sort values, not offsets: deleting or adding items between
+// requests doesn't repeat or skip the ones that stayed
+func TestListCursorSurvivesChanges(t *testing.T) {
+	items := testListItems()
+	q, _ := parseListQuery(t, "sort=name&limit=3")
+	first, next, _ := testListSpec.Apply(items, q)
+	if !slices.Equal(ids(first), []int{2, 5, 8}) {
+		t.Fatalf("first page %v", ids(first))
+	}
+
+	changed := slices.DeleteFunc(slices.Clone(items), func(it listItem) bool { return it.ID == 8 || it.ID == 1 })
+	changed = append(changed, listItem{ID: 11, Name: "aaron"}, listItem{ID: 12, Name: "bo"})
+
+	q, errs := parseListQuery(t, "sort=name&limit=3&cursor="+next)
+	if errs != nil {
+		t.Fatal(errs)
+	}
+	second, _, _ := testListSpec.Apply(changed, q)
+	if want := []int{12, 3, 6}; !slices.Equal(ids(second), want) {
+		t.Errorf("second page %v, want %v", ids(second), want)
+	}
+}
+
+func TestListQueryErrors(t *testing.T) {
+	valid := encodeCursor("id", []any{int64(3)})
+	b64 := func(s string) string { return base64.RawURLEncoding.EncodeToString([]byte(s)) }
+
+	tests := []struct {
+		query string
+		field string
+	}{
+		{"limit=0", "limit"},
+		{"limit=6", "limit"},
+		{"limit=ten", "limit"},
+		{"sort=password", "sort"},
+		{"filter[password]=x", "filter[password]"},
+		{"cursor=!!!", "cursor"},
+		{"cursor=" + b64("not json"), "cursor"},
+		{"cursor=" + b64(`{"s":"id","v":[]}`), "cursor"},
+		{"cursor=" + b64(`{"s":"id","v":[1,2]}`), "cursor"},
+		{"cursor=" + b64(`{"s":"id","v":[1.5]}`), "cursor"},
+		{"cursor=" + b64(`{"s":"id","v":[1e400]}`), "cursor"},
+		{"cursor=" + b64(`{"s":"-id","v":[3]}`), "cursor"}, // Sort swapped
+		{"sort=-id&cursor=" + valid, "cursor"},             // Cursor from another sort
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			_, errs := parseListQuery(t, tt.query)
+			if _, ok := errs[tt.field]; !ok {
+				t.Errorf("no error for %s: %v", tt.field, errs)
+			}
+		})
+	}
+
+	if _, errs := parseListQuery(t, "cursor="+valid); errs != nil {
+		t.Errorf("valid cursor rejected: %v", errs)
+	}
+}
+
+func TestListTypedFilters(t *testing.T) {
+	items := testListItems()
+	tests := []struct {
+		query string
+		want  []int
+		err   string
+	}{
+		{"filter[id]=4", []int{4}, ""},
+		{"filter[id]=04", []int{4}, ""},
+		{"filter[id]=four", nil, "filter[id]"},
+		{"filter[name]=carol", []int{4, 10}, ""},
+		{"filter[created]=2026-01-01T01:00:00Z", []int{2, 5, 8}, ""},
+		{"filter[created]=2026-01-01T02:00:00%2B01:00", []int{2, 5, 8}, ""}, // Same instant as 01:00Z
+		{"filter[created]=2026-01-01", nil, "filter[created]"},
+		{"filter[id]=2&filter[name]=alice", []int{2}, ""},
+		{"filter[id]=1&filter[name]=alice", []int{}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			q, errs := parseListQuery(t, tt.query+"&limit=5")
+			if errs != nil {
+				t.Fatal(errs)
+			}
+			page, _, errs := testListSpec.Apply(items, q)
+			if tt.err != "" {
+				if _, ok := errs[tt.err]; !ok {
+					t.Errorf("no error for %s: %v", tt.err, errs)
+				}
+				return
+			}
+			if errs != nil {
+				t.Fatal(errs)
+			}
+			if !slices.Equal(ids(page), tt.want) {
+				t.Errorf("got %v, want %v", ids(page), tt.want)
+			}
+		})
+	}
+}
+
+func TestListHandlerLinks(t *testing.T) {
+	items := testListItems()
+	h := listHandler(testListSpec,
+		func(r *http.Request) ([]listItem, error) { return items, nil },
+		func(it listItem) int { return it.ID })
+
+	get := func(target string) (*httptest.ResponseRecorder, listPage[int]) {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("GET", target, nil))
+		var body listPage[int]
+		json.Unmarshal(w.Body.Bytes(), &body)
+		return w, body
+	}
+
+	w, body := get("/items?sort=-id&limit=4&q=")
+	if w.Code != 200 || !slices.Equal(body.Data, []int{10, 9, 8, 7}) || body.Limit != 4 || body.NextCursor == nil {
+		t.Fatalf("first page: %d %+v", w.Code, body)
+	}
+	next := "/items?" + url.Values{"cursor": {*body.NextCursor}, "limit": {"4"}, "q": {""}, "sort": {"-id"}}.Encode()
+	wantLink := `</items?limit=4&q=&sort=-id>; rel="first", <` + next + `>; rel="next"`
+	if got := w.Header().Get("Link"); got != wantLink {
+		t.Errorf("Link\n got %s\nwant %s", got, wantLink)
+	}
+
+	// Following rel="next" works, and the last page has no next link
+	w, body = get(next)
+	if !slices.Equal(body.Data, []int{6, 5, 4, 3}) {
+		t.Fatalf("second page %v", body.Data)
+	}
+	_, body = get("/items?" + url.Values{"cursor": {*body.NextCursor}, "limit": {"4"}, "sort": {"-id"}}.Encode())
+	if !slices.Equal(body.Data, []int{2, 1}) || body.NextCursor != nil {
+		t.Errorf("last page %+v", body)
+	}
+
+	w, _ = get("/items?limit=4&filter[id]=x")
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("bad filter: %d", w.Code)
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ==========================================
+// LOGIN BRUTE-FORCE PROTECTION
+// ==========================================
+// Failed logins are counted per username and per client IP:
+//
+//   - every failure makes the next answer slower (250ms, 500ms, 1s, ... 5s)
+//   - after Threshold failures the username is locked for Cooldown
+//   - after IPThreshold failures the IP is locked for Cooldown
+//     (one IP trying many usernames = credential stuffing)
+//
+// Usernames are tracked whether the account exists or not, so a lockout
+// doesn't reveal which accounts are real. Counters are forgotten after
+// Cooldown without failures, or when the user logs in.
+//
+// Checking a password takes a while (scrypt), so Check reserves the
+// attempt and Fail, Succeed or Release settles it. Attempts still in
+// flight count towards the threshold: firing 100 guesses at once gets no
+// more through than sending them one by one.
+
+var ErrLoginLocked = errors.New("too many failed logins")
+
+// Where security events go (lockouts, unlocks), as JSON on stderr
+var auditLog = slog.New(slog.NewJSONHandler(os.Stderr, nil)).With("log", "audit")
+
+// Progressive delay bounds
+const (
+	loginBaseDelay = 250 * time.Millisecond
+	loginMaxDelay  = 5 * time.Second
+)
+
+type failureRecord struct {
+	failures    int
+	pending     int // Attempts let through by Check, not yet settled
+	last        time.Time
+	lockedUntil time.Time
+}
+
+// Failures that still count: they are forgiven after cooldown
+func (rec *failureRecord) recent(now time.Time, cooldown time.Duration) int {
+	if now.Sub(rec.last) > cooldown {
+		return 0
+	}
+	return rec.failures
+}
+
+// LoginGuard tracks failed logins; safe for concurrent use
+type LoginGuard struct {
+	Threshold   int // Failures before a username is locked (0 = never)
+	IPThreshold int // Failures before an IP is locked (0 = never)
+	Cooldown    time.Duration
+
+	mu      sync.Mutex
+	records map[string]*failureRecord // "user:alice" or "ip:10.0.0.1"
+}
+
+func NewLoginGuard(threshold, ipThreshold int, cooldown time.Duration) *LoginGuard {
+	return &LoginGuard{
+		Threshold:   threshold,
+		IPThreshold: ipThreshold,
+		Cooldown:    cooldown,
+		records:     make(map[string]*failureRecord),
+	}
+}
+
+func userLockKey(username string) string { return "user:" + strings.ToLower(username) }
+func ipLockKey(ip string) string         { return "ip:" + ip }
+
+// Check returns ErrLoginLocked and the time left if the username or the
+// IP is locked out, or would be if the attempts in flight all fail.
+// Otherwise it reserves an attempt, which the caller must settle with
+// Fail, Succeed or Release.
+func (g *LoginGuard) Check(username, ip string, now time.Time) (time.Duration, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	keys := []string{userLockKey(username), ipLockKey(ip)}
+	thresholds := []int{g.Threshold, g.IPThreshold}
+
+	var wait time.Duration
+	for i, key := range keys {
+		rec, ok := g.records[key]
+		if !ok {
+			continue
+		}
+		if now.Before(rec.lockedUntil) {
+			wait = max(wait, rec.lockedUntil.Sub(now))
+		} else if thresholds[i] > 0 && rec.recent(now, g.Cooldown)+rec.pending >= thresholds[i] {
+			wait = max(wait, loginMaxDelay) // Decided by the attempts in flight
+		}
+	}
+	if wait > 0 {
+		return wait, ErrLoginLocked
+	}
+
+	for _, key := range keys {
+		g.recordLocked(key).pending++
+	}
+	return 0, nil
+}
+
+// Fail records a failed login and returns how long to wait before
+// answering. Reaching a threshold locks the key and writes an audit entry.
+func (g *LoginGuard) Fail(r *http.Request, username, ip string, now time.Time) time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	userFailures := g.failLocked(r, userLockKey(username), g.Threshold, now)
+	g.failLocked(r, ipLockKey(ip), g.IPThreshold, now)
+
+	delay := loginBaseDelay << min(userFailures-1, 5)
+	return min(delay, loginMaxDelay)
+}
+
+// The record for key, created if needed. Caller holds the lock.
+func (g *LoginGuard) recordLocked(key string) *failureRecord {
+	rec, ok := g.records[key]
+	if !ok {
+		rec = &failureRecord{}
+		g.records[key] = rec
+	}
+	return rec
+}
+
+// Settle one reserved attempt. Unlock may have dropped the record since,
+// so this never goes below zero. Caller holds the lock.
+func (g *LoginGuard) settleLocked(key string) *failureRecord {
+	rec := g.recordLocked(key)
+	rec.pending = max(rec.pending-1, 0)
+	return rec
+}
+
+func (g *LoginGuard) failLocked(r *http.Request, key string, threshold int, now time.Time) int {
+	rec := g.settleLocked(key)
+	rec.failures = rec.recent(now, g.Cooldown) // Old failures are forgiven
+	rec.failures++
+	rec.last = now
+	if threshold > 0 && rec.failures >= threshold && !now.Before(rec.lockedUntil) {
+		rec.lockedUntil = now.Add(g.Cooldown)
+		auditLog.LogAttrs(r.Context(), slog.LevelWarn, "login lockout",
+			slog.String("key", key),
+			slog.Int("failures", rec.failures),
+			slog.Time("until", rec.lockedUntil),
+			slog.String("remote", clientIP(r)),
+			slog.String("request_id", requestID(r)),
+		)
+	}
+	return rec.failures
+}
+
+// Succeed forgets the username's failures. The IP's stay: a stuffing
+// run that guesses one password right shouldn't get a clean slate.
+func (g *LoginGuard) Succeed(username, ip string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.records, userLockKey(username))
+	g.settleLocked(ipLockKey(ip))
+}
+
+// Release settles an attempt that ended neither way, like a store error
+func (g *LoginGuard) Release(username, ip string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.settleLocked(userLockKey(username))
+	g.settleLocked(ipLockKey(ip))
+}
+
+// Unlock lifts a lockout ("user:alice" or "ip:10.0.0.1"), returns false if
+// there was nothing to unlock
+func (g *LoginGuard) Unlock(key string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	_, ok := g.records[key]
+	delete(g.records, key)
+	return ok
+}
+
+// Lockout is one active lock, as shown by the admin API
+type Lockout struct {
+	Key         string    `json:"key"`
+	Failures    int       `json:"failures"`
+	LockedUntil time.Time `json:"locked_until"`
+}
+
+// Locked lists the active lockouts, sorted by key
+func (g *LoginGuard) Locked(now time.Time) []Lockout {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	out := []Lockout{}
+	for key, rec := range g.records {
+		if now.Before(rec.lockedUntil) {
+			out = append(out, Lockout{Key: key, Failures: rec.failures, LockedUntil: rec.lockedUntil})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+	return out
+}
+
+// startJanitor forgets records with no failure for Cooldown, no active
+// lock and no attempt in flight, every interval until ctx is cancelled
+func (g *LoginGuard) startJanitor(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				g.mu.Lock()
+				for key, rec := range g.records {
+					if now.Sub(rec.last) > g.Cooldown && !now.Before(rec.lockedUntil) && rec.pending == 0 {
+						delete(g.records, key)
+					}
+				}
+				g.mu.Unlock()
+			}
+		}
+	}()
+}
+
+// Wait for d, or until the client gives up
+func sleepCtx(ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+	}
+}
+
+// lockedProblem tells a locked-out client when to come back
+func lockedProblem(w http.ResponseWriter, wait time.Duration) *Problem {
+	w.Header().Set("Retry-After", fmt.Sprint(ceilSeconds(wait)))
+	return NewProblem(http.StatusTooManyRequests,
+		fmt.Sprintf("Too many failed logins. Try again in %d minute(s).", (ceilSeconds(wait)+59)/60))
+}
+
+// ==========================================
+// ADMIN: LIST AND LIFT LOCKOUTS
+// ==========================================
+//   GET    /api/lockouts          active lockouts
+//   DELETE /api/lockouts/{key}    unlock, key is user:<name> or ip:<addr>
+
+func apiLockoutsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{"data": loginGuard.Locked(time.Now())})
+}
+
+func apiUnlockHandler(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	if !loginGuard.Unlock(key) {
+		writeProblem(w, r, NewProblem(http.StatusNotFound, "no failed logins recorded for "+key))
+		return
+	}
+	auditLog.LogAttrs(r.Context(), slog.LevelInfo, "login unlock",
+		slog.String("key", key),
+		slog.String("by", currentSession(r).Username),
+		slog.String("request_id", requestID(r)),
+	)
+	w.WriteHeader(http.StatusNoContent)
+}
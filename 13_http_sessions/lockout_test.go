@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var lockoutStart = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func TestLoginGuardThreshold(t *testing.T) {
+	g := NewLoginGuard(3, 0, 15*time.Minute)
+	r := httptest.NewRequest("POST", "/login", nil)
+	now := lockoutStart
+
+	var delays []time.Duration
+	for range 3 {
+		if _, err := g.Check("alice", "192.0.2.1", now); err != nil {
+			t.Fatalf("locked too early: %v", err)
+		}
+		delays = append(delays, g.Fail(r, "alice", "192.0.2.1", now))
+	}
+	want := []time.Duration{250 * time.Millisecond, 500 * time.Millisecond, time.Second}
+	for i := range want {
+		if delays[i] != want[i] {
+			t.Errorf("delay %d: %v, want %v", i+1, delays[i], want[i])
+		}
+	}
+
+	wait, err := g.Check("ALICE", "192.0.2.9", now.Add(time.Minute))
+	if !errors.Is(err, ErrLoginLocked) || wait != 14*time.Minute {
+		t.Errorf("after 3 failures: %v, %v", wait, err)
+	}
+	if _, err := g.Check("bob", "192.0.2.1", now); err != nil {
+		t.Errorf("other user locked: %v", err)
+	}
+	g.Release("bob", "192.0.2.1")
+
+	// The lock ends after the cooldown, and the old failures are forgiven
+	later := now.Add(16 * time.Minute)
+	if _, err := g.Check("alice", "192.0.2.1", later); err != nil {
+		t.Fatalf("still locked: %v", err)
+	}
+	if d := g.Fail(r, "alice", "192.0.2.1", later); d != 250*time.Millisecond {
+		t.Errorf("first failure after cooldown waits %v", d)
+	}
+}
+
+func TestLoginGuardSucceedAndRelease(t *testing.T) {
+	g := NewLoginGuard(2, 3, time.Hour)
+	r := httptest.NewRequest("POST", "/login", nil)
+	ip := "192.0.2.1"
+
+	g.Check("alice", ip, lockoutStart)
+	g.Fail(r, "alice", ip, lockoutStart)
+
+	// Success clears the username, but not the IP's count
+	g.Check("alice", ip, lockoutStart)
+	g.Succeed("alice", ip)
+	g.Check("alice", ip, lockoutStart)
+	g.Fail(r, "alice", ip, lockoutStart)
+	if _, err := g.Check("alice", ip, lockoutStart); err != nil {
+		t.Fatalf("username not cleared by success: %v", err)
+	}
+	g.Fail(r, "alice", ip, lockoutStart)
+
+	// That was the IP's third failure
+	if _, err := g.Check("carol", ip, lockoutStart); !errors.Is(err, ErrLoginLocked) {
+		t.Errorf("IP not locked: %v", err)
+	}
+	if got := g.Locked(lockoutStart); len(got) != 2 || got[0].Key != "ip:"+ip || got[1].Key != "user:alice" {
+		t.Errorf("Locked() = %+v", got)
+	}
+
+	// Released attempts don't count
+	for range 5 {
+		if _, err := g.Check("dave", "192.0.2.2", lockoutStart); err != nil {
+			t.Fatalf("released attempts counted: %v", err)
+		}
+		g.Release("dave", "192.0.2.2")
+	}
+}
+
+// Parallel guesses all pass Check before any of them fails. Each one
+// must still count, or the threshold could be overshot at will.
+func TestLoginGuardParallelGuesses(t *testing.T) {
+	for _, tt := range []struct {
+		name               string
+		threshold, ipLimit int
+		usernames          []string
+		wantLock           string
+	}{
+		{"one user", 3, 0, []string{"alice"}, "user:alice"},
+		{"stuffing", 0, 4, []string{"a1", "a2", "a3", "a4", "a5", "a6", "a7", "a8"}, "ip:192.0.2.1"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewLoginGuard(tt.threshold, tt.ipLimit, time.Hour)
+			r := httptest.NewRequest("POST", "/login", nil)
+			limit := max(tt.threshold, tt.ipLimit)
+
+			var passed atomic.Int32
+			var checked, done sync.WaitGroup
+			release := make(chan struct{})
+			for i := range 50 {
+				username := tt.usernames[i%len(tt.usernames)]
+				checked.Add(1)
+				done.Add(1)
+				go func() {
+					defer done.Done()
+					_, err := g.Check(username, "192.0.2.1", lockoutStart)
+					checked.Done()
+					if err != nil {
+						return
+					}
+					passed.Add(1)
+					<-release // Everyone checks before anyone fails (scrypt is slow)
+					g.Fail(r, username, "192.0.2.1", lockoutStart)
+				}()
+			}
+			checked.Wait()
+			close(release)
+			done.Wait()
+
+			if n := int(passed.Load()); n != limit {
+				t.Errorf("%d guesses got through, want %d", n, limit)
+			}
+			if _, err := g.Check(tt.usernames[0], "192.0.2.1", lockoutStart); !errors.Is(err, ErrLoginLocked) {
+				t.Errorf("not locked after the guesses failed: %v", err)
+			}
+			if locked := g.Locked(lockoutStart); len(locked) != 1 || locked[0].Key != tt.wantLock {
+				t.Errorf("Locked() = %+v, want %s", locked, tt.wantLock)
+			}
+		})
+	}
+}
+
+// While an attempt is in flight that could still succeed, others wait
+// for it rather than being counted as failures
+func TestLoginGuardPendingThenSuccess(t *testing.T) {
+	g := NewLoginGuard(1, 0, time.Hour)
+	if _, err := g.Check("alice", "192.0.2.1", lockoutStart); err != nil {
+		t.Fatal(err)
+	}
+	wait, err := g.Check("alice", "192.0.2.2", lockoutStart)
+	if !errors.Is(err, ErrLoginLocked) || wait != loginMaxDelay {
+		t.Errorf("second attempt in flight: %v, %v", wait, err)
+	}
+
+	g.Succeed("alice", "192.0.2.1")
+	if _, err := g.Check("alice", "192.0.2.2", lockoutStart); err != nil {
+		t.Errorf("after success: %v", err)
+	}
+
+	// Unlock while an attempt is in flight: settling it must not go negative
+	g.Unlock("user:alice")
+	g.Release("alice", "192.0.2.2")
+	if _, err := g.Check("alice", "192.0.2.2", lockoutStart); err != nil {
+		t.Errorf("after unlock: %v", err)
+	}
+}
@@ -1,268 +1,602 @@
-// ============================================================
-// LESSON 13: HTTP Server with Sessions & Cookies
-// ============================================================
-// Build web servers with Go's built-in net/http package
-// Handle sessions, cookies, JSON, and routing
-//
-// TO RUN: go run main.go
-// Then open http://localhost:8080 in your browser
-// ============================================================
-
-package main
-
-import (
-	"encoding/json"
-	"fmt"
-	"html/template"
-	"log"
-	"net/http"
-	"sync"
-	"time"
-)
-
-// ==========================================
-// IN-MEMORY SESSION STORE
-// ==========================================
-
-type Session struct {
-	Username  string
-	LoginTime time.Time
-	Data      map[string]string
-}
-
-var (
-	sessions = make(map[string]*Session)
-	mu       sync.RWMutex // For thread-safe access
-)
-
-// Generate simple session ID (use UUID in production!)
-func generateSessionID() string {
-	return fmt.Sprintf("sess_%d", time.Now().UnixNano())
-}
-
-// Get session from cookie
-func getSession(r *http.Request) *Session {
-	cookie, err := r.Cookie("session_id")
-	if err != nil {
-		return nil
-	}
-	mu.RLock()
-	defer mu.RUnlock()
-	return sessions[cookie.Value]
-}
-
-// Create new session
-func createSession(w http.ResponseWriter, username string) *Session {
-	sessionID := generateSessionID()
-	session := &Session{
-		Username:  username,
-		LoginTime: time.Now(),
-		Data:      make(map[string]string),
-	}
-
-	mu.Lock()
-	sessions[sessionID] = session
-	mu.Unlock()
-
-	// Set cookie
-	http.SetCookie(w, &http.Cookie{
-		Name:     "session_id",
-		Value:    sessionID,
-		Path:     "/",
-		MaxAge:   3600, // 1 hour
-		HttpOnly: true,
-	})
-
-	return session
-}
-
-// Delete session
-func deleteSession(w http.ResponseWriter, r *http.Request) {
-	cookie, err := r.Cookie("session_id")
-	if err == nil {
-		mu.Lock()
-		delete(sessions, cookie.Value)
-		mu.Unlock()
-	}
-
-	// Clear cookie
-	http.SetCookie(w, &http.Cookie{
-		Name:   "session_id",
-		Value:  "",
-		Path:   "/",
-		MaxAge: -1,
-	})
-}
-
-// ==========================================
-// HTTP HANDLERS
-// ==========================================
-
-// Home page
-func homeHandler(w http.ResponseWriter, r *http.Request) {
-	session := getSession(r)
-
-	html := `<!DOCTYPE html>
-<html>
-<head><title>Go HTTP Session Demo</title>
-<style>
-    body { font-family: Arial; max-width: 600px; margin: 50px auto; padding: 20px; }
-    .card { background: #f5f5f5; padding: 20px; border-radius: 8px; margin: 20px 0; }
-    a { color: #007bff; }
-    input, button { padding: 10px; margin: 5px 0; }
-    button { background: #007bff; color: white; border: none; cursor: pointer; }
-</style>
-</head>
-<body>
-    <h1>🚀 Go HTTP Session Demo</h1>`
-
-	if session != nil {
-		html += fmt.Sprintf(`
-    <div class="card">
-        <h2>Welcome, %s!</h2>
-        <p>Logged in at: %s</p>
-        <p><a href="/dashboard">Go to Dashboard</a></p>
-        <p><a href="/logout">Logout</a></p>
-    </div>`, session.Username, session.LoginTime.Format("3:04 PM"))
-	} else {
-		html += `
-    <div class="card">
-        <h2>Login</h2>
-        <form action="/login" method="POST">
-            <input type="text" name="username" placeholder="Username" required><br>
-            <button type="submit">Login</button>
-        </form>
-    </div>`
-	}
-
-	html += `
-    <h3>API Endpoints:</h3>
-    <ul>
-        <li><a href="/api/time">/api/time</a> - Get current time (JSON)</li>
-        <li><a href="/api/users">/api/users</a> - Get users (JSON)</li>
-    </ul>
-</body></html>`
-
-	w.Header().Set("Content-Type", "text/html")
-	fmt.Fprint(w, html)
-}
-
-// Login handler
-func loginHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		http.Redirect(w, r, "/", http.StatusSeeOther)
-		return
-	}
-
-	username := r.FormValue("username")
-	if username == "" {
-		http.Error(w, "Username required", http.StatusBadRequest)
-		return
-	}
-
-	createSession(w, username)
-	log.Printf("User '%s' logged in", username)
-	http.Redirect(w, r, "/", http.StatusSeeOther)
-}
-
-// Logout handler
-func logoutHandler(w http.ResponseWriter, r *http.Request) {
-	session := getSession(r)
-	if session != nil {
-		log.Printf("User '%s' logged out", session.Username)
-	}
-	deleteSession(w, r)
-	http.Redirect(w, r, "/", http.StatusSeeOther)
-}
-
-// Dashboard (protected route)
-func dashboardHandler(w http.ResponseWriter, r *http.Request) {
-	session := getSession(r)
-	if session == nil {
-		http.Redirect(w, r, "/", http.StatusSeeOther)
-		return
-	}
-
-	html := fmt.Sprintf(`<!DOCTYPE html>
-<html>
-<head><title>Dashboard</title></head>
-<body>
-    <h1>Dashboard</h1>
-    <p>Hello, %s! This is a protected page.</p>
-    <p>Session started: %s</p>
-    <p><a href="/">Home</a> | <a href="/logout">Logout</a></p>
-</body></html>`, session.Username, session.LoginTime.Format(time.RFC1123))
-
-	w.Header().Set("Content-Type", "text/html")
-	fmt.Fprint(w, html)
-}
-
-// ==========================================
-// JSON API ENDPOINTS
-// ==========================================
-
-// API: Get current time
-func apiTimeHandler(w http.ResponseWriter, r *http.Request) {
-	response := map[string]interface{}{
-		"time":      time.Now().Format(time.RFC3339),
-		"timestamp": time.Now().Unix(),
-		"timezone":  time.Now().Location().String(),
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
-}
-
-// API: Get users (demo)
-func apiUsersHandler(w http.ResponseWriter, r *http.Request) {
-	users := []map[string]interface{}{
-		{"id": 1, "name": "Alice", "email": "alice@example.com"},
-		{"id": 2, "name": "Bob", "email": "bob@example.com"},
-		{"id": 3, "name": "Charlie", "email": "charlie@example.com"},
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(users)
-}
-
-// ==========================================
-// MIDDLEWARE
-// ==========================================
-
-// Logging middleware
-func loggingMiddleware(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-		log.Printf("→ %s %s", r.Method, r.URL.Path)
-		next(w, r)
-		log.Printf("← %s %s (%v)", r.Method, r.URL.Path, time.Since(start))
-	}
-}
-
-// ==========================================
-// MAIN
-// ==========================================
-
-func main() {
-	// Routes
-	http.HandleFunc("/", loggingMiddleware(homeHandler))
-	http.HandleFunc("/login", loggingMiddleware(loginHandler))
-	http.HandleFunc("/logout", loggingMiddleware(logoutHandler))
-	http.HandleFunc("/dashboard", loggingMiddleware(dashboardHandler))
-	http.HandleFunc("/api/time", loggingMiddleware(apiTimeHandler))
-	http.HandleFunc("/api/users", loggingMiddleware(apiUsersHandler))
-
-	// Start server
-	port := ":8080"
-	fmt.Println("===========================================")
-	fmt.Println("🚀 Go HTTP Server with Sessions")
-	fmt.Println("===========================================")
-	fmt.Printf("Server running at http://localhost%s\n", port)
-	fmt.Println("Press Ctrl+C to stop")
-	fmt.Println("===========================================")
-
-	log.Fatal(http.ListenAndServe(port, nil))
-}
-
-// Unused but useful: template example
-var _ = template.Must(template.New("example").Parse(`{{.}}`))
+// ============================================================
+// LESSON 13: HTTP Server with Sessions & Cookies
+// ============================================================
+// Build web servers with Go's built-in net/http package
+// Handle sessions, cookies, JSON, and routing
+//
+// TO RUN: go build -o server *.go && ./server
+//   ./server -store=file -store-path=sessions.json -users-path=users.json
+//   ./server -session-ttl=8h -session-idle=15m
+//   ./server -dev    (edit templates/ without restarting)
+//   ./server -access-log-format=combined -access-log=access.log
+//   ./server -rate-login=5/m -rate-api=off
+//   ./server -lockout-threshold=3 -lockout-cooldown=5m -admins=alice
+//   ./server -shutdown-delay=5s    (behind a load balancer polling /readyz)
+//   ./server -tls -addr=:8443 -http-redirect-addr=:8080    (https://localhost:8443)
+//   curl -N localhost:8080/api/time/stream?interval=5    (Server-Sent Events)
+//   curl -H "Authorization: Bearer pat_..." localhost:8080/api/users    (token from /dashboard)
+//   ./server -jwt-alg=RS256 -jwt-access-ttl=5m    (then POST /api/auth/login)
+//   log in, then open /chat in two browsers    (WebSocket chat)
+//   PORT=9000 ./server    or    ./server -addr=unix:/tmp/demo.sock
+//   SESSION_KEYS="k2:<base64>,k1:<base64>" ./server -session-mode=cookie -cookie-encrypt
+// Then open http://localhost:8080 in your browser
+//
+// TO TEST: go test *.go
+// ============================================================
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ==========================================
+// SESSIONS
+// ==========================================
+
+type Session struct {
+	Username    string
+	LoginTime   time.Time
+	LastAccess  time.Time
+	ExpiresAt   time.Time     // Absolute timeout: dead after this, no matter what
+	IdleTimeout time.Duration // Sliding timeout: dead if unused for this long
+	Roles       []string      // Copied from the user at login (see auth.go)
+	Permissions []string      // Roles expanded, plus the user's extra grants
+	Data        map[string]string
+}
+
+// clone copies the session, Data included
+func (s *Session) clone() *Session {
+	c := *s
+	c.Roles = slices.Clone(s.Roles)
+	c.Permissions = slices.Clone(s.Permissions)
+	c.Data = maps.Clone(s.Data)
+	return &c
+}
+
+// Expired reports whether either timeout has passed
+func (s *Session) Expired(now time.Time) bool {
+	if !s.ExpiresAt.IsZero() && now.After(s.ExpiresAt) {
+		return true
+	}
+	if s.IdleTimeout > 0 && now.Sub(s.LastAccess) > s.IdleTimeout {
+		return true
+	}
+	return false
+}
+
+var (
+	// Where sessions live (see store.go), chosen in main()
+	store SessionStore = NewMemoryStore()
+
+	// Set in cookie mode: sessions live in the cookie itself
+	// (see cookiesession.go) and store is not used
+	cookieCodec *CookieCodec
+
+	// Registered accounts (see users.go)
+	userStore UserStore
+
+	// Personal access tokens for the API (see tokens.go)
+	tokenStore *FileTokenStore
+
+	// Page templates (see templates.go)
+	renderer *Renderer
+
+	// Failed login tracking (see lockout.go)
+	loginGuard = NewLoginGuard(5, 20, 15*time.Minute)
+
+	// JWTs for the SPA (see jwtauth.go), settings from flags
+	jwtIssuer = NewJWTIssuer()
+
+	// Timeouts for new sessions, set from flags in main()
+	sessionTTL  = time.Hour
+	sessionIdle = 30 * time.Minute
+)
+
+// Generate a random session ID: 256 bits from crypto/rand,
+// so it can't be guessed and two logins never collide
+func generateSessionID() string {
+	b := make([]byte, 32)
+	rand.Read(b) // Never fails (crashes the program instead)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Get session from cookie
+func getSession(r *http.Request) *Session {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return nil
+	}
+	if cookieCodec != nil {
+		session, err := cookieCodec.Decode(cookie.Value)
+		if err != nil || session.Expired(time.Now()) {
+			return nil
+		}
+		noteUser(r, session.Username)
+		return session
+	}
+
+	session, err := store.Get(cookie.Value)
+	if err != nil {
+		return nil
+	}
+	store.Touch(cookie.Value)
+	noteUser(r, session.Username)
+	return session
+}
+
+// Create new session. Always issues a fresh ID; if the request still
+// carries an old session cookie, that ID is invalidated in the same step
+// (prevents session fixation). flashes are shown on the next page.
+func createSession(w http.ResponseWriter, r *http.Request, user *User, flashes ...Flash) *Session {
+	sessionID := generateSessionID()
+	noteUser(r, user.Username)
+	now := time.Now()
+	session := &Session{
+		Username:    user.Username,
+		LoginTime:   now,
+		LastAccess:  now,
+		ExpiresAt:   now.Add(sessionTTL),
+		IdleTimeout: sessionIdle,
+		Roles:       slices.Clone(user.Roles),
+		Permissions: effectivePermissions(user.Roles, user.Permissions),
+		Data:        make(map[string]string),
+	}
+	if len(flashes) > 0 {
+		setFlashes(session, flashes)
+	}
+
+	if cookieCodec != nil {
+		// The cookie is the session: nothing to store, and the old
+		// cookie is simply overwritten. LastAccess can't slide without
+		// re-issuing the cookie on every request, so no idle timeout.
+		session.IdleTimeout = 0
+		value, err := cookieCodec.Encode(session)
+		if err != nil {
+			log.Printf("encoding session cookie: %v", err)
+			return session
+		}
+		sessionID = value
+	} else if old, err := r.Cookie(sessionCookieName); err == nil {
+		err = store.Rotate(old.Value, sessionID, session)
+		if err != nil {
+			log.Printf("rotating session: %v", err)
+		}
+	} else if err := store.Save(sessionID, session); err != nil {
+		log.Printf("saving session: %v", err)
+	}
+
+	setSessionCookie(w, sessionID, session.ExpiresAt)
+	return session
+}
+
+// Set the session cookie, living as long as the session can
+func setSessionCookie(w http.ResponseWriter, value string, expires time.Time) {
+	http.SetCookie(w, newCookie(sessionCookieName, value, int(time.Until(expires).Seconds())))
+}
+
+// Delete session
+func deleteSession(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err == nil && cookieCodec == nil {
+		if err := store.Delete(cookie.Value); err != nil {
+			log.Printf("deleting session: %v", err)
+		}
+	}
+
+	// Clear cookie
+	http.SetCookie(w, newCookie(sessionCookieName, "", -1))
+}
+
+// Delete every stored session of username, for when the account is
+// deleted. Cookie sessions can't be reached: they end at their expiry.
+func deleteUserSessions(username string) (int, error) {
+	if cookieCodec != nil {
+		return 0, nil
+	}
+	all, err := store.List()
+	if err != nil {
+		return 0, err
+	}
+	var ids []string
+	for id, session := range all {
+		if strings.EqualFold(session.Username, username) {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	return len(ids), store.Delete(ids...)
+}
+
+// ==========================================
+// HTTP HANDLERS
+// ==========================================
+
+// Data handed to every page template
+type pageData struct {
+	Session   *Session
+	CSRFToken string      // Goes in a hidden field of every form
+	Flashes   []Flash     // One-shot messages (see sessiondata.go)
+	Next      string      // Where to go after logging in (?next=)
+	Problem   *Problem    // Set on the error page
+	Tokens    *tokensPage // API tokens on the dashboard (see tokens.go)
+}
+
+// Home page
+func homeHandler(w http.ResponseWriter, r *http.Request) {
+	renderer.Render(w, "home", pageData{
+		Session:   getSession(r),
+		CSRFToken: csrfToken(w, r),
+		Flashes:   popFlashes(w, r),
+		Next:      safeNext(r.URL.Query().Get("next")),
+	})
+}
+
+// attemptLogin checks a password with the lockout rules around it. It
+// answers the request itself on failure and returns nil.
+// Shared by the login form and the JWT login (see jwtauth.go).
+func attemptLogin(w http.ResponseWriter, r *http.Request, username, password string) *User {
+	if username == "" || password == "" {
+		writeProblem(w, r, validationProblem(FieldErrors{"username": "and password are required"}))
+		return nil
+	}
+
+	// Locked out: don't even check the password (see lockout.go)
+	ip := clientIP(r)
+	if wait, err := loginGuard.Check(username, ip, time.Now()); err != nil {
+		loginAttempts.Inc("locked")
+		writeProblem(w, r, lockedProblem(w, wait))
+		return nil
+	}
+
+	user, err := authenticate(userStore, username, password)
+	if errors.Is(err, ErrBadCredentials) {
+		log.Printf("Failed login for '%s'", username)
+		loginAttempts.Inc("failure")
+		sleepCtx(r.Context(), loginGuard.Fail(r, username, ip, time.Now()))
+		writeProblem(w, r, NewProblem(http.StatusUnauthorized, "Invalid username or password."))
+		return nil
+	}
+	if err != nil {
+		loginGuard.Release(username, ip)
+		writeError(w, r, err)
+		return nil
+	}
+	loginGuard.Succeed(username, ip)
+	loginAttempts.Inc("success")
+	return user
+}
+
+// Login handler
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	user := attemptLogin(w, r, r.FormValue("username"), r.FormValue("password"))
+	if user == nil {
+		return
+	}
+
+	createSession(w, r, user, Flash{"success", "Logged in as " + user.Username})
+	log.Printf("User '%s' logged in", user.Username)
+	http.Redirect(w, r, safeNext(r.FormValue("next")), http.StatusSeeOther)
+}
+
+// Register handler: create an account, then log straight in
+func registerHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := registerUser(userStore, r.FormValue("username"),
+		r.FormValue("email"), r.FormValue("password"))
+	if errors.Is(err, ErrUserExists) || errors.Is(err, ErrEmailTaken) {
+		writeProblem(w, r, &Problem{Type: problemConflict, Title: "Already exists",
+			Status: http.StatusConflict, Detail: err.Error()})
+		return
+	}
+	if err != nil {
+		writeError(w, r, err) // FieldErrors are a 400, anything else a 500
+		return
+	}
+
+	createSession(w, r, user, Flash{"success", "Welcome, " + user.Username + "! Your account is ready."})
+	log.Printf("User '%s' registered", user.Username)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// Logout handler (POST only, so a link or <img> elsewhere can't log you out)
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	session := getSession(r)
+	if session != nil {
+		log.Printf("User '%s' logged out", session.Username)
+	}
+	deleteSession(w, r)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// Dashboard (protected route)
+func dashboardHandler(w http.ResponseWriter, r *http.Request) {
+	renderDashboard(w, r, http.StatusOK, "")
+}
+
+// ==========================================
+// JSON API ENDPOINTS
+// ==========================================
+
+// API: Get current time
+func apiTimeHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, newTimeTick(time.Now()))
+}
+
+// ==========================================
+// MAIN
+// ==========================================
+
+func main() {
+	storeKind := flag.String("store", "memory", "session store: memory or file")
+	storePath := flag.String("store-path", "sessions.json", "file used by -store=file")
+	flag.DurationVar(&sessionTTL, "session-ttl", sessionTTL, "absolute session lifetime")
+	flag.DurationVar(&sessionIdle, "session-idle", sessionIdle, "idle timeout (0 disables)")
+	reapEvery := flag.Duration("reap-interval", time.Minute, "how often expired sessions are removed (0 = never)")
+	sessionMode := flag.String("session-mode", "server", "server (stored on the server) or cookie (signed cookie, no store)")
+	cookieEncrypt := flag.Bool("cookie-encrypt", false, "encrypt cookie sessions with AES-GCM")
+	usersPath := flag.String("users-path", "users.json", "JSON file holding user accounts")
+	tokensPath := flag.String("tokens-path", "tokens.json", "JSON file holding API token hashes")
+	dev := flag.Bool("dev", false, "reload templates from disk on every request")
+	templatesDir := flag.String("templates-dir", "templates", "template directory used by -dev")
+	logFormat := flag.String("access-log-format", "json", "access log format: json, logfmt or combined")
+	logDest := flag.String("access-log", "stdout", "access log destination: stdout, stderr or a file path")
+	logMaxSize := flag.Int("access-log-max-size", 100, "rotate the access log file at this many MB (0 = never)")
+	logMaxAge := flag.Duration("access-log-max-age", 24*time.Hour, "rotate the access log file after this long (0 = never)")
+	logKeep := flag.Int("access-log-keep", 7, "rotated access log files to keep (0 = all)")
+	addr := flag.String("addr", defaultAddr(), "listen address: host:port, unix:/path.sock or systemd ($ADDR, $PORT)")
+	readTimeout := flag.Duration("read-timeout", 15*time.Second, "max time to read a whole request")
+	readHeaderTimeout := flag.Duration("read-header-timeout", 5*time.Second, "max time to read request headers")
+	writeTimeout := flag.Duration("write-timeout", 30*time.Second, "max time to write a response")
+	idleTimeout := flag.Duration("idle-timeout", 2*time.Minute, "how long idle keep-alive connections stay open")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 15*time.Second, "how long to wait for requests on shutdown")
+	tlsOn := flag.Bool("tls", false, "serve HTTPS with a self-signed development certificate")
+	tlsCert := flag.String("tls-cert", "", "TLS certificate file (turns on HTTPS)")
+	tlsKey := flag.String("tls-key", "", "TLS private key file")
+	tlsDir := flag.String("tls-dir", ".tls", "where -tls keeps its development certificate")
+	httpRedirectAddr := flag.String("http-redirect-addr", "", "with TLS: also listen here on plain HTTP and redirect to HTTPS")
+	cookieSecureFlag := flag.Bool("cookie-secure", false, "mark cookies Secure without -tls (TLS ends at a proxy)")
+	cookieSameSiteFlag := flag.String("cookie-samesite", "lax", "SameSite attribute for cookies: lax or strict")
+	shutdownDelay := flag.Duration("shutdown-delay", 0, "how long /readyz fails before listeners close on shutdown")
+	rateLogin := flag.String("rate-login", "10/m", "login/register requests per client IP (\"off\" disables)")
+	flag.IntVar(&loginGuard.Threshold, "lockout-threshold", loginGuard.Threshold, "failed logins before a username is locked (0 = never)")
+	flag.IntVar(&loginGuard.IPThreshold, "lockout-ip-threshold", loginGuard.IPThreshold, "failed logins before a client IP is locked (0 = never)")
+	flag.DurationVar(&loginGuard.Cooldown, "lockout-cooldown", loginGuard.Cooldown, "how long a lockout lasts")
+	admins := flag.String("admins", "", "comma-separated usernames given the admin role")
+	rateAPI := flag.String("rate-api", "120/m", "API requests per token, user or IP (\"off\" disables)")
+	jwtAlg := flag.String("jwt-alg", algEdDSA, "algorithm for new JWT signing keys: HS256, RS256 or EdDSA")
+	jwtKeysDir := flag.String("jwt-keys-dir", ".jwt", "where JWT signing keys are kept (\"\" = new keys every start)")
+	jwtRotate := flag.Duration("jwt-rotate", 24*time.Hour, "how often a new JWT signing key is made (0 = never)")
+	flag.StringVar(&jwtIssuer.Issuer, "jwt-issuer", jwtIssuer.Issuer, "JWT iss claim")
+	flag.StringVar(&jwtIssuer.Audience, "jwt-audience", jwtIssuer.Audience, "JWT aud claim")
+	flag.DurationVar(&jwtIssuer.AccessTTL, "jwt-access-ttl", jwtIssuer.AccessTTL, "JWT access token lifetime")
+	flag.DurationVar(&jwtIssuer.RefreshTTL, "jwt-refresh-ttl", jwtIssuer.RefreshTTL, "JWT refresh token lifetime")
+	flag.DurationVar(&jwtIssuer.Leeway, "jwt-leeway", jwtIssuer.Leeway, "clock skew allowed when checking JWT times")
+	flag.Parse()
+
+	// Cancelled on Ctrl+C or SIGTERM, which starts the graceful shutdown
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	logOut, err := openAccessLogOutput(*logDest, *logMaxSize, *logMaxAge, *logKeep)
+	if err != nil {
+		log.Fatal(err)
+	}
+	accessLog, err = newAccessLogger(*logFormat, logOut)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if c, ok := logOut.(io.Closer); ok && logOut != os.Stdout && logOut != os.Stderr {
+		onShutdown("close access log", func(context.Context) error { return c.Close() })
+	}
+
+	rend, err := NewRenderer(*dev, *templatesDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	renderer = rend
+
+	u, err := NewFileUserStore(*usersPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	userStore = u
+
+	t, err := NewFileTokenStore(*tokensPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	tokenStore = t
+
+	switch *sessionMode {
+	case "server":
+		s, err := newSessionStore(*storeKind, *storePath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		store = s
+		startReaper(ctx, store, *reapEvery)
+		if c, ok := store.(io.Closer); ok {
+			onShutdown("flush session store", func(context.Context) error { return c.Close() })
+		}
+	case "cookie":
+		// Comma-separated "kid:base64secret" list, signing key first
+		var keys []string
+		if env := os.Getenv("SESSION_KEYS"); env != "" {
+			keys = strings.Split(env, ",")
+		} else {
+			log.Println("SESSION_KEYS not set: using a random key, cookies won't survive a restart")
+			keys = []string{generateCookieSecret("dev")}
+		}
+		codec, err := NewCookieCodec(keys, *cookieEncrypt)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cookieCodec = codec
+		*storeKind = "cookie"
+	default:
+		log.Fatalf("unknown session mode: %s", *sessionMode)
+	}
+
+	for _, name := range strings.Split(*admins, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			bootstrapAdmins[strings.ToLower(name)] = true
+		}
+	}
+	if err := grantBootstrapAdmins(userStore); err != nil {
+		log.Fatal(err)
+	}
+	loginGuard.startJanitor(ctx, time.Minute)
+
+	// Old keys must verify until the last refresh token they signed expires
+	keys, err := NewJWTKeySet(*jwtAlg, *jwtKeysDir, *jwtRotate, jwtIssuer.RefreshTTL+jwtIssuer.Leeway)
+	if err != nil {
+		log.Fatal(err)
+	}
+	jwtIssuer.Keys = keys
+	keys.startRotation(ctx)
+	jwtIssuer.startJanitor(ctx, time.Minute)
+
+	// Health checks (see health.go)
+	liveness.Add("locks", checkLocks)
+	readiness.Add("shutdown", checkShutdown)
+	readiness.Add("user_store", checkUserStore)
+	readiness.Add("token_store", checkTokenStore)
+	if cookieCodec == nil {
+		readiness.Add("session_store", checkSessionStore)
+	}
+
+	// Rate limits (see ratelimit.go)
+	loginPolicy, err := parseRatePolicy("login", *rateLogin, rateKeyIP)
+	if err != nil {
+		log.Fatal(err)
+	}
+	apiPolicy, err := parseRatePolicy("api", *rateAPI, rateKeyClient)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Routes (see router.go)
+	router := NewRouter()
+	router.Use(requestIDMiddleware, loggingMiddleware, metricsMiddleware, securityHeaders, recoverMiddleware)
+
+	router.Get("/", homeHandler)
+	router.Get("/metrics", metricsHandler) // Prometheus scrape target (see metrics.go)
+	router.Get("/static/{file}", staticHandler)
+	router.Get("/healthz", liveness.Handler)
+	router.Get("/readyz", readiness.Handler)
+	router.Get("/.well-known/jwks.json", jwtIssuer.Keys.JWKSHandler)
+
+	protected := router.Group("", RequireAuth) // See auth.go
+	protected.Get("/dashboard", dashboardHandler)
+	protected.Get("/chat", chatPageHandler)
+	protected.Get("/chat/ws", chatSocketHandler) // WebSocket (see chat.go)
+
+	forms := router.Group("", csrfMiddleware)
+	forms.Post("/logout", logoutHandler)
+
+	tokens := router.Group("/tokens", RequireAuth, csrfMiddleware)
+	tokens.Post("/", createTokenHandler)
+	tokens.Post("/{id}/revoke", revokeTokenHandler)
+
+	loginLimit := rateLimit(ctx, loginPolicy) // One budget for both login forms
+	auth := router.Group("", loginLimit, csrfMiddleware)
+	auth.Post("/login", loginHandler)
+	auth.Post("/register", registerHandler)
+
+	jwtAuth := router.Group("/api/auth", loginLimit) // See jwtauth.go
+	jwtAuth.Post("/login", jwtLoginHandler)
+	jwtAuth.Post("/refresh", jwtRefreshHandler)
+	jwtAuth.Post("/logout", jwtLogoutHandler)
+
+	// Cookie, API token or JWT; the limit is keyed on who bearerAuth verified
+	api := router.Group("/api", bearerAuth, rateLimit(ctx, apiPolicy), rejectBadBearer)
+	api.Get("/time", apiTimeHandler)
+	api.Get("/time/stream", apiTimeStreamHandler) // Server-Sent Events (see sse.go)
+
+	usersRead := api.Group("/users", RequirePermission(permUsersRead))
+	usersRead.Get("/", apiUsersHandler)
+	usersRead.Get("/{id}", apiUserHandler)
+
+	usersWrite := api.Group("/users", RequirePermission(permUsersWrite), csrfMiddleware)
+	usersWrite.Post("/", apiCreateUserHandler)
+	usersWrite.Put("/{id}", apiReplaceUserHandler)
+	usersWrite.Patch("/{id}", apiPatchUserHandler)
+	usersWrite.Delete("/{id}", apiDeleteUserHandler)
+
+	sess := api.Group("/session", cookieSessionOnly, csrfMiddleware)
+	sess.Get("/", apiSessionHandler)
+	sess.Get("/data/{key}", apiSessionGetHandler)
+	sess.Put("/data/{key}", apiSessionPutHandler)
+	sess.Patch("/data", apiSessionPatchHandler)
+	sess.Delete("/data/{key}", apiSessionDeleteHandler)
+
+	admin := api.Group("/lockouts", RequirePermission(permLockoutsManage), csrfMiddleware)
+	admin.Get("/", apiLockoutsHandler)
+	admin.Delete("/{key}", apiUnlockHandler)
+
+	if *dev {
+		router.Get("/debug/routes", router.routesHandler)
+	}
+
+	// TLS and cookie attributes (see security.go)
+	useTLS := *tlsOn || *tlsCert != "" || *tlsKey != ""
+	if err := hardenCookies(useTLS || *cookieSecureFlag, *cookieSameSiteFlag); err != nil {
+		log.Fatal(err)
+	}
+
+	// Start server (see server.go)
+	srv := &http.Server{
+		Handler:           router,
+		ReadTimeout:       *readTimeout,
+		ReadHeaderTimeout: *readHeaderTimeout,
+		WriteTimeout:      *writeTimeout,
+		IdleTimeout:       *idleTimeout,
+	}
+	srv.RegisterOnShutdown(timeTicks.Close) // Shutdown doesn't wait for open streams to end by themselves
+	onShutdown("close chat connections", chatRoom.Close)
+	ln, err := listen(*addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if useTLS {
+		cfg, err := tlsConfig(*tlsCert, *tlsKey, *tlsDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ln = tls.NewListener(ln, cfg)
+		if *httpRedirectAddr != "" {
+			startHTTPSRedirect(*httpRedirectAddr, ln)
+		}
+	}
+
+	fmt.Println("===========================================")
+	fmt.Println("🚀 Go HTTP Server with Sessions")
+	fmt.Println("===========================================")
+	fmt.Printf("Server running at %s\n", listenURL(ln, useTLS))
+	fmt.Printf("Session store: %s (ttl %v, idle %v)\n", *storeKind, sessionTTL, sessionIdle)
+	fmt.Println("Press Ctrl+C to stop")
+	fmt.Println("===========================================")
+
+	if err := serve(ctx, srv, ln, *shutdownDelay, *shutdownTimeout); err != nil {
+		log.Fatal(err)
+	}
+	log.Println("Server stopped")
+}
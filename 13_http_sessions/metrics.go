@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ==========================================
+// METRICS (PROMETHEUS TEXT FORMAT)
+// ==========================================
+// GET /metrics returns plain text Prometheus can scrape:
+//
+//   # HELP http_requests_total Requests handled, by route and status.
+//   # TYPE http_requests_total counter
+//   http_requests_total{method="GET",route="/api/users/{id}",status="200"} 3
+//
+// No client library: a few metric types that write themselves to any
+// io.Writer, so the output is easy to check in a test or by eye.
+// Labels use the route pattern, not the raw path, so /api/users/1 and
+// /api/users/2 share one series instead of growing without bound. The
+// method is made up by the client too, so unknown ones become "OTHER".
+
+// collector is anything that can print its samples
+type collector interface {
+	writeTo(w io.Writer)
+}
+
+// MetricsRegistry holds metrics in the order they are printed
+type MetricsRegistry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+func (m *MetricsRegistry) register(c collector) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.collectors = append(m.collectors, c)
+}
+
+// WriteTo prints every metric in the text exposition format
+func (m *MetricsRegistry) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	list := append([]collector{}, m.collectors...)
+	m.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	cw := &countingWriter{w: bw}
+	for _, c := range list {
+		c.writeTo(cw)
+	}
+	return cw.n, bw.Flush()
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// {a="1",b="2"} with values escaped as the format requires
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = name + `="` + escape.Replace(values[i]) + `"`
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, +1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// ==========================================
+// COUNTER
+// ==========================================
+
+// CounterVec is a counter split by label values
+type CounterVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	series map[string]*counterSeries // Key: label values joined by \xff
+}
+
+type counterSeries struct {
+	values []string
+	count  float64
+}
+
+func (m *MetricsRegistry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{name: name, help: help, labels: labels, series: map[string]*counterSeries{}}
+	m.register(c)
+	return c
+}
+
+// Inc adds one to the series with these label values
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+func (c *CounterVec) Add(v float64, values ...string) {
+	if len(values) != len(c.labels) {
+		panic(fmt.Sprintf("metrics: %s wants %d label values, got %d", c.name, len(c.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.series[key]
+	if !ok {
+		s = &counterSeries{values: append([]string{}, values...)}
+		c.series[key] = s
+	}
+	s.count += v
+}
+
+func (c *CounterVec) writeTo(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	writeHeader(w, c.name, c.help, "counter")
+	for _, key := range sortedKeys(c.series) {
+		s := c.series[key]
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, s.values), formatFloat(s.count))
+	}
+}
+
+// ==========================================
+// HISTOGRAM
+// ==========================================
+
+// Request latency buckets in seconds (the usual Prometheus defaults)
+var defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// HistogramVec counts observations into buckets, split by label values
+type HistogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64 // Upper bounds, ascending; +Inf is implied
+
+	mu     sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	values []string
+	counts []uint64 // Per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func (m *MetricsRegistry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{name: name, help: help, labels: labels, buckets: buckets, series: map[string]*histogramSeries{}}
+	m.register(h)
+	return h
+}
+
+// Observe records one value for the series with these label values
+func (h *HistogramVec) Observe(v float64, values ...string) {
+	if len(values) != len(h.labels) {
+		panic(fmt.Sprintf("metrics: %s wants %d label values, got %d", h.name, len(h.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{values: append([]string{}, values...), counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *HistogramVec) writeTo(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	writeHeader(w, h.name, h.help, "histogram")
+	names := append(append([]string{}, h.labels...), "le")
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		var cumulative uint64
+		for i := 0; i <= len(h.buckets); i++ {
+			upper := math.Inf(+1)
+			if i < len(h.buckets) {
+				upper = h.buckets[i]
+				cumulative += s.counts[i]
+			} else {
+				cumulative = s.count // Includes values above the last bucket
+			}
+			values := append(append([]string{}, s.values...), formatFloat(upper))
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(names, values), cumulative)
+		}
+		labels := formatLabels(h.labels, s.values)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labels, formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labels, s.count)
+	}
+}
+
+// ==========================================
+// GAUGES READ AT SCRAPE TIME
+// ==========================================
+
+// GaugeFunc asks fn for its value on every scrape. fn returning false
+// means "no value right now" and the sample is left out.
+type GaugeFunc struct {
+	name, help string
+	fn         func() (float64, bool)
+}
+
+func (m *MetricsRegistry) NewGaugeFunc(name, help string, fn func() (float64, bool)) {
+	m.register(&GaugeFunc{name: name, help: help, fn: fn})
+}
+
+func (g *GaugeFunc) writeTo(w io.Writer) {
+	v, ok := g.fn()
+	if !ok {
+		return
+	}
+	writeHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.name, formatFloat(v))
+}
+
+// collectorFunc adapts a plain function, used for the Go runtime stats
+type collectorFunc func(w io.Writer)
+
+func (f collectorFunc) writeTo(w io.Writer) { f(w) }
+
+var processStart = time.Now()
+
+// Go runtime stats, read once per scrape
+func writeRuntimeMetrics(w io.Writer) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	sample := func(name, help, kind string, v float64) {
+		writeHeader(w, name, help, kind)
+		fmt.Fprintf(w, "%s %s\n", name, formatFloat(v))
+	}
+	writeHeader(w, "go_info", "Information about the Go environment.", "gauge")
+	fmt.Fprintf(w, "go_info%s 1\n", formatLabels([]string{"version"}, []string{runtime.Version()}))
+	sample("go_goroutines", "Number of goroutines that currently exist.", "gauge", float64(runtime.NumGoroutine()))
+	sample("go_memstats_alloc_bytes", "Bytes of allocated heap objects.", "gauge", float64(ms.Alloc))
+	sample("go_memstats_sys_bytes", "Bytes of memory obtained from the OS.", "gauge", float64(ms.Sys))
+	sample("go_memstats_heap_objects", "Number of allocated heap objects.", "gauge", float64(ms.HeapObjects))
+	sample("go_gc_cycles_total", "Completed GC cycles.", "counter", float64(ms.NumGC))
+	sample("go_gc_pause_seconds_total", "Total time spent in GC stop-the-world pauses.", "counter",
+		float64(ms.PauseTotalNs)/1e9)
+	sample("process_start_time_seconds", "Start time of the process since the Unix epoch.", "gauge",
+		float64(processStart.Unix()))
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ==========================================
+// SERVER METRICS
+// ==========================================
+
+var (
+	metrics = &MetricsRegistry{}
+
+	httpRequests = metrics.NewCounterVec("http_requests_total",
+		"Requests handled, by route and status.", "method", "route", "status")
+	httpDuration = metrics.NewHistogramVec("http_request_duration_seconds",
+		"Time to handle a request, by route and status.", defaultBuckets, "method", "route", "status")
+	loginAttempts = metrics.NewCounterVec("login_attempts_total",
+		"Login attempts by result: success, failure or locked.", "result")
+)
+
+func init() {
+	metrics.NewGaugeFunc("sessions_active", "Unexpired sessions in the session store.", countActiveSessions)
+	metrics.register(collectorFunc(writeRuntimeMetrics))
+	for _, result := range []string{"success", "failure", "locked"} {
+		loginAttempts.Add(0, result) // Show zeros before the first login
+	}
+}
+
+// Not available in cookie mode: the sessions are in the browsers
+func countActiveSessions() (float64, bool) {
+	if cookieCodec != nil {
+		return 0, false
+	}
+	all, err := store.List()
+	if err != nil {
+		return 0, false
+	}
+	now := time.Now()
+	n := 0
+	for _, s := range all {
+		if !s.Expired(now) {
+			n++
+		}
+	}
+	return float64(n), true
+}
+
+type routeKey struct{}
+
+// noteRoute records which route pattern matched, for the route label.
+// Router.dispatch calls it.
+func noteRoute(r *http.Request, pattern string) {
+	if p, ok := r.Context().Value(routeKey{}).(*string); ok {
+		*p = pattern
+	}
+}
+
+// metricsMiddleware counts and times every request
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := wrapResponseWriter(w)
+		route := new(string)
+		*route = "unmatched" // 404s and 405s
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), routeKey{}, route)))
+
+		status := strconv.Itoa(sw.Status())
+		method := metricMethod(r.Method)
+		httpRequests.Inc(method, *route, status)
+		httpDuration.Observe(time.Since(start).Seconds(), method, *route, status)
+	})
+}
+
+// metricMethod keeps the method label to a fixed set of values
+func metricMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodOptions, http.MethodConnect, http.MethodTrace:
+		return method
+	}
+	return "OTHER"
+}
+
+// GET /metrics
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metrics.WriteTo(w)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMetricsExposition(t *testing.T) {
+	m := &MetricsRegistry{}
+	requests := m.NewCounterVec("requests_total", "Requests handled.", "method", "status")
+	duration := m.NewHistogramVec("duration_seconds", "Time taken.", []float64{0.1, 1}, "route")
+	m.NewGaugeFunc("queue_length", "Items waiting.", func() (float64, bool) { return 3, true })
+	m.NewGaugeFunc("hidden", "Left out.", func() (float64, bool) { return 0, false })
+
+	requests.Inc("GET", "200")
+	requests.Add(2, "GET", "200")
+	requests.Inc("POST", `say "hi"`+"\n")
+	duration.Observe(0.05, "/a")
+	duration.Observe(0.5, "/a")
+	duration.Observe(7, "/a")
+
+	var out strings.Builder
+	n, err := m.WriteTo(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `# HELP requests_total Requests handled.
+# TYPE requests_total counter
+requests_total{method="GET",status="200"} 3
+requests_total{method="POST",status="say \"hi\"\n"} 1
+# HELP duration_seconds Time taken.
+# TYPE duration_seconds histogram
+duration_seconds_bucket{route="/a",le="0.1"} 1
+duration_seconds_bucket{route="/a",le="1"} 2
+duration_seconds_bucket{route="/a",le="+Inf"} 3
+duration_seconds_sum{route="/a"} 7.55
+duration_seconds_count{route="/a"} 3
+# HELP queue_length Items waiting.
+# TYPE queue_length gauge
+queue_length 3
+`
+	if out.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", out.String(), want)
+	}
+	if n != int64(len(want)) {
+		t.Errorf("WriteTo returned %d, wrote %d bytes", n, len(want))
+	}
+}
+
+func TestMetricMethod(t *testing.T) {
+	for method, want := range map[string]string{
+		"GET":    "GET",
+		"DELETE": "DELETE",
+		"get":    "OTHER",
+		"FOO1":   "OTHER",
+	} {
+		if got := metricMethod(method); got != want {
+			t.Errorf("metricMethod(%q) = %q, want %q", method, got, want)
+		}
+	}
+}
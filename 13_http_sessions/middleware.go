@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"regexp"
+	"runtime/debug"
+	"time"
+)
+
+// ==========================================
+// MIDDLEWARE CHAIN
+// ==========================================
+
+// Middleware wraps a handler with extra behaviour
+type Middleware func(http.Handler) http.Handler
+
+// Chain combines middleware into one. The first one is the outermost:
+// Chain(a, b)(h) runs a, then b, then h.
+func Chain(mw ...Middleware) Middleware {
+	return func(h http.Handler) http.Handler {
+		for i := len(mw) - 1; i >= 0; i-- {
+			h = mw[i](h)
+		}
+		return h
+	}
+}
+
+// ==========================================
+// RESPONSE WRITER WRAPPER
+// ==========================================
+
+// statusWriter remembers the status code and body size of a response.
+// It keeps Flush and Hijack working for streaming and WebSockets.
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	wroteHeader bool
+}
+
+// Wrap w, or reuse it if an outer middleware already did
+func wrapResponseWriter(w http.ResponseWriter) *statusWriter {
+	if sw, ok := w.(*statusWriter); ok {
+		return sw
+	}
+	return &statusWriter{ResponseWriter: w, status: http.StatusOK}
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.status = code
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *statusWriter) Flush() {
+	w.wroteHeader = true
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	w.wroteHeader = true
+	w.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+// Unwrap lets http.ResponseController reach the real writer
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Status and Bytes report what was sent so far
+func (w *statusWriter) Status() int  { return w.status }
+func (w *statusWriter) Bytes() int64 { return w.bytes }
+
+// ==========================================
+// REQUEST IDS
+// ==========================================
+
+type requestIDKey struct{}
+
+// Accept IDs from upstream proxies only if they look sane
+var validRequestID = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,64}$`)
+
+// Request ID middleware: reuses X-Request-ID from the client or proxy,
+// otherwise makes one. It is echoed back and stored in the context.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID.MatchString(id) {
+			b := make([]byte, 8)
+			rand.Read(b)
+			id = hex.EncodeToString(b)
+		}
+
+		w.Header().Set("X-Request-ID", id)
+		ctx := context.WithValue(r.Context(), requestIDKey{}, id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// requestID returns the ID set by requestIDMiddleware, or ""
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// ==========================================
+// PANIC RECOVERY
+// ==========================================
+
+// Recovery middleware: a panicking handler logs its stack and the client
+// gets a 500, instead of the connection just dropping
+func recoverMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := wrapResponseWriter(w)
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			if err == http.ErrAbortHandler { // Deliberate abort, let net/http handle it
+				panic(err)
+			}
+
+			log.Printf("panic [%s] %s %s: %v\n%s", requestID(r), r.Method, r.URL.Path, err, debug.Stack())
+			if !sw.wroteHeader {
+				writeProblem(sw, r, internalProblem())
+			}
+		}()
+		next.ServeHTTP(sw, r)
+	})
+}
+
+// ==========================================
+// LOGGING
+// ==========================================
+
+type logUserKey struct{}
+
+// noteUser records who made the request, so the access log can show it.
+// getSession and createSession call it.
+func noteUser(r *http.Request, username string) {
+	if p, ok := r.Context().Value(logUserKey{}).(*string); ok {
+		*p = username
+	}
+}
+
+// Logging middleware: one structured entry per request (see accesslog.go)
+func loggingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := wrapResponseWriter(w)
+		user := new(string)
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), logUserKey{}, user)))
+
+		level := slog.LevelInfo
+		switch {
+		case sw.Status() >= 500:
+			level = slog.LevelError
+		case sw.Status() >= 400:
+			level = slog.LevelWarn
+		}
+
+		accessLog.LogAttrs(r.Context(), level, "request",
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.RequestURI()),
+			slog.String("proto", r.Proto),
+			slog.Int("status", sw.Status()),
+			slog.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.Int64("bytes", sw.Bytes()),
+			slog.String("remote", clientIP(r)),
+			slog.String("user_agent", r.UserAgent()),
+			slog.String("referer", r.Referer()),
+			slog.String("user", *user),
+			slog.String("request_id", requestID(r)),
+		)
+	})
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"strings"
+)
+
+// ==========================================
+// PASSWORD HASHING (scrypt)
+// ==========================================
+// scrypt is "memory-hard": every guess needs a big chunk of RAM, which
+// makes GPU/ASIC cracking expensive. The standard library doesn't ship
+// it, so this is a small implementation of RFC 7914.
+//
+// Stored format (salt and key in base64):
+//
+//   $scrypt$ln=15,r=8,p=1$<salt>$<key>
+//
+// The parameters travel with the hash, so old hashes keep verifying after
+// the defaults are raised, and get upgraded on the next login.
+
+// ScryptParams are the cost settings: N = 2^LogN, block size R, parallelism P
+type ScryptParams struct {
+	LogN uint8
+	R    int
+	P    int
+}
+
+// Current defaults (~32MB of memory per hash)
+var defaultScrypt = ScryptParams{LogN: 15, R: 8, P: 1}
+
+const (
+	saltLen = 16
+	keyLen  = 32
+)
+
+var ErrBadPasswordHash = errors.New("malformed password hash")
+
+// hashPassword hashes with a fresh random salt and the default parameters
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, saltLen)
+	rand.Read(salt)
+
+	p := defaultScrypt
+	key, err := scrypt([]byte(password), salt, 1<<p.LogN, p.R, p.P, keyLen)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("$scrypt$ln=%d,r=%d,p=%d$%s$%s", p.LogN, p.R, p.P,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// verifyPassword checks password against a stored hash. needsRehash is true
+// when the hash was made with weaker parameters than the current defaults.
+func verifyPassword(password, encoded string) (ok, needsRehash bool, err error) {
+	params, salt, want, err := parsePasswordHash(encoded)
+	if err != nil {
+		return false, false, err
+	}
+
+	got, err := scrypt([]byte(password), salt, 1<<params.LogN, params.R, params.P, len(want))
+	if err != nil {
+		return false, false, err
+	}
+	if subtle.ConstantTimeCompare(got, want) != 1 {
+		return false, false, nil
+	}
+
+	weaker := params.LogN < defaultScrypt.LogN || params.R < defaultScrypt.R ||
+		params.P < defaultScrypt.P || len(salt) < saltLen
+	return true, weaker, nil
+}
+
+func parsePasswordHash(encoded string) (ScryptParams, []byte, []byte, error) {
+	var p ScryptParams
+	// "", "scrypt", "ln=..,r=..,p=..", salt, key
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 5 || parts[0] != "" || parts[1] != "scrypt" {
+		return p, nil, nil, ErrBadPasswordHash
+	}
+	if _, err := fmt.Sscanf(parts[2], "ln=%d,r=%d,p=%d", &p.LogN, &p.R, &p.P); err != nil {
+		return p, nil, nil, ErrBadPasswordHash
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return p, nil, nil, ErrBadPasswordHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil || len(key) == 0 {
+		return p, nil, nil, ErrBadPasswordHash
+	}
+	return p, salt, key, nil
+}
+
+// scrypt derives a keyLen-byte key (RFC 7914)
+func scrypt(password, salt []byte, N, r, p, keyLen int) ([]byte, error) {
+	if N <= 1 || N&(N-1) != 0 {
+		return nil, errors.New("scrypt: N must be a power of two > 1")
+	}
+	if r <= 0 || p <= 0 || r*p >= 1<<30 || N > 1<<30/(128*r) {
+		return nil, errors.New("scrypt: parameters too large")
+	}
+
+	// 1. Stretch the password into p blocks of 128*r bytes
+	b, err := pbkdf2.Key(sha256.New, string(password), salt, 1, p*128*r)
+	if err != nil {
+		return nil, err
+	}
+
+	// 2. Run the memory-hard mixing on each block
+	words := 32 * r // One block as uint32s
+	x := make([]uint32, words)
+	v := make([]uint32, N*words)
+	y := make([]uint32, words)
+	for i := 0; i < p; i++ {
+		block := b[i*128*r : (i+1)*128*r]
+		for j := range x {
+			x[j] = binary.LittleEndian.Uint32(block[j*4:])
+		}
+		roMix(x, v, y, N, r)
+		for j := range x {
+			binary.LittleEndian.PutUint32(block[j*4:], x[j])
+		}
+	}
+
+	// 3. Squeeze the mixed blocks back into the final key
+	return pbkdf2.Key(sha256.New, string(password), b, 1, keyLen)
+}
+
+// roMix fills v with N successive states of x, then reads them back in a
+// data-dependent order. That order forces the whole of v to stay in memory.
+func roMix(x, v, y []uint32, N, r int) {
+	words := 32 * r
+	for i := 0; i < N; i++ {
+		copy(v[i*words:], x)
+		blockMix(x, y, r)
+	}
+	for i := 0; i < N; i++ {
+		j := int(x[(2*r-1)*16] & uint32(N-1)) // Integerify
+		for k := range x {
+			x[k] ^= v[j*words+k]
+		}
+		blockMix(x, y, r)
+	}
+}
+
+// blockMix runs Salsa20/8 across the 2r 64-byte chunks of b.
+// Outputs are stored even chunks first, then odd ones.
+func blockMix(b, y []uint32, r int) {
+	var t [16]uint32
+	copy(t[:], b[(2*r-1)*16:])
+	for i := 0; i < 2*r; i++ {
+		for k := range t {
+			t[k] ^= b[i*16+k]
+		}
+		salsa208(&t)
+		dst := (i/2)*16 + (i%2)*r*16
+		copy(y[dst:], t[:])
+	}
+	copy(b, y)
+}
+
+// salsa208 is the Salsa20 core reduced to 8 rounds
+func salsa208(b *[16]uint32) {
+	x := *b
+	rotl := bits.RotateLeft32
+	for i := 0; i < 8; i += 2 {
+		// Columns
+		x[4] ^= rotl(x[0]+x[12], 7)
+		x[8] ^= rotl(x[4]+x[0], 9)
+		x[12] ^= rotl(x[8]+x[4], 13)
+		x[0] ^= rotl(x[12]+x[8], 18)
+		x[9] ^= rotl(x[5]+x[1], 7)
+		x[13] ^= rotl(x[9]+x[5], 9)
+		x[1] ^= rotl(x[13]+x[9], 13)
+		x[5] ^= rotl(x[1]+x[13], 18)
+		x[14] ^= rotl(x[10]+x[6], 7)
+		x[2] ^= rotl(x[14]+x[10], 9)
+		x[6] ^= rotl(x[2]+x[14], 13)
+		x[10] ^= rotl(x[6]+x[2], 18)
+		x[3] ^= rotl(x[15]+x[11], 7)
+		x[7] ^= rotl(x[3]+x[15], 9)
+		x[11] ^= rotl(x[7]+x[3], 13)
+		x[15] ^= rotl(x[11]+x[7], 18)
+		// Rows
+		x[1] ^= rotl(x[0]+x[3], 7)
+		x[2] ^= rotl(x[1]+x[0], 9)
+		x[3] ^= rotl(x[2]+x[1], 13)
+		x[0] ^= rotl(x[3]+x[2], 18)
+		x[6] ^= rotl(x[5]+x[4], 7)
+		x[7] ^= rotl(x[6]+x[5], 9)
+		x[4] ^= rotl(x[7]+x[6], 13)
+		x[5] ^= rotl(x[4]+x[7], 18)
+		x[11] ^= rotl(x[10]+x[9], 7)
+		x[8] ^= rotl(x[11]+x[10], 9)
+		x[9] ^= rotl(x[8]+x[11], 13)
+		x[10] ^= rotl(x[9]+x[8], 18)
+		x[12] ^= rotl(x[15]+x[14], 7)
+		x[13] ^= rotl(x[12]+x[15], 9)
+		x[14] ^= rotl(x[13]+x[12], 13)
+		x[15] ^= rotl(x[14]+x[13], 18)
+	}
+	for i := range b {
+		b[i] += x[i]
+	}
+}
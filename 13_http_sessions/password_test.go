@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test vectors from RFC 7914 section 12
+func TestScryptRFC7914(t *testing.T) {
+	tests := []struct {
+		password, salt string
+		N, r, p        int
+		want           string
+	}{
+		{"", "", 16, 1, 1,
+			"77d6576238657b203b19ca42c18a0497f16b4844e3074ae8dfdffa3fede21442" +
+				"fcd0069ded0948f8326a753a0fc81f17e8d3e0fb2e0d3628cf35e20c38d18906"},
+		{"password", "NaCl", 1024, 8, 16,
+			"fdbabe1c9d3472007856e7190d01e9fe7c6ad7cbc8237830e77376634b373162" +
+				"2eaf30d92e22a3886ff109279d9830dac727afb94a83ee6d8360cbdfa2cc0640"},
+		{"pleaseletmein", "SodiumChloride", 16384, 8, 1,
+			"7023bdcb3afd7348461c06cd81fd38ebfda8fbba904f8e3ea9b543f6545da1f2" +
+				"d5432955613f0fcf62d49705242a9af9e61e85dc0d651e40dfcf017b45575887"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.password, func(t *testing.T) {
+			key, err := scrypt([]byte(tt.password), []byte(tt.salt), tt.N, tt.r, tt.p, 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := hex.EncodeToString(key); got != tt.want {
+				t.Errorf("got  %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScryptBadParams(t *testing.T) {
+	for _, N := range []int{0, 1, 3, 1000} {
+		if _, err := scrypt([]byte("pw"), nil, N, 8, 1, 32); err == nil {
+			t.Errorf("N=%d: expected an error", N)
+		}
+	}
+	if _, err := scrypt([]byte("pw"), nil, 16, 0, 1, 32); err == nil {
+		t.Error("r=0: expected an error")
+	}
+}
+
+// Cheap parameters so the tests stay fast; restored afterwards
+func withScryptDefaults(t *testing.T, p ScryptParams) {
+	t.Helper()
+	old := defaultScrypt
+	defaultScrypt = p
+	t.Cleanup(func() { defaultScrypt = old })
+}
+
+func TestHashAndVerifyPassword(t *testing.T) {
+	withScryptDefaults(t, ScryptParams{LogN: 10, R: 8, P: 1})
+
+	hash, err := hashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hash, "$scrypt$ln=10,r=8,p=1$") {
+		t.Fatalf("unexpected format %q", hash)
+	}
+	if other, _ := hashPassword("correct horse"); other == hash {
+		t.Error("two hashes of the same password share a salt")
+	}
+
+	if ok, rehash, err := verifyPassword("correct horse", hash); !ok || rehash || err != nil {
+		t.Errorf("right password: ok=%v rehash=%v err=%v", ok, rehash, err)
+	}
+	if ok, _, err := verifyPassword("wrong horse", hash); ok || err != nil {
+		t.Errorf("wrong password: ok=%v err=%v", ok, err)
+	}
+
+	// Raising the defaults marks the old hash for an upgrade
+	defaultScrypt.LogN = 11
+	if ok, rehash, _ := verifyPassword("correct horse", hash); !ok || !rehash {
+		t.Errorf("after raising N: ok=%v rehash=%v", ok, rehash)
+	}
+
+	for _, bad := range []string{
+		"",
+		"plaintext",
+		"$bcrypt$ln=10,r=8,p=1$c2FsdA$a2V5",
+		"$scrypt$n=10$c2FsdA$a2V5",
+		"$scrypt$ln=10,r=8,p=1$!!$a2V5",
+		"$scrypt$ln=10,r=8,p=1$c2FsdA$",
+	} {
+		if _, _, err := verifyPassword("pw", bad); !errors.Is(err, ErrBadPasswordHash) {
+			t.Errorf("%q: got %v, want ErrBadPasswordHash", bad, err)
+		}
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	withScryptDefaults(t, ScryptParams{LogN: 10, R: 8, P: 1})
+	users, _ := NewFileUserStore("")
+	if _, err := registerUser(users, "alice", "", "password123"); err != nil {
+		t.Fatal(err)
+	}
+
+	if u, err := authenticate(users, "alice", "password123"); err != nil || u.Username != "alice" {
+		t.Fatalf("good login: %v, %v", u, err)
+	}
+	if _, err := authenticate(users, "ALICE", "password123"); err != nil {
+		t.Errorf("usernames are case-insensitive: %v", err)
+	}
+	if _, err := authenticate(users, "alice", "password124"); !errors.Is(err, ErrBadCredentials) {
+		t.Errorf("wrong password: got %v", err)
+	}
+	if _, err := authenticate(users, "nobody", "password123"); !errors.Is(err, ErrBadCredentials) {
+		t.Errorf("unknown user: got %v", err)
+	}
+}
+
+func TestAuthenticateRehashesOnLogin(t *testing.T) {
+	withScryptDefaults(t, ScryptParams{LogN: 10, R: 8, P: 1})
+	users, _ := NewFileUserStore("")
+	user, err := registerUser(users, "alice", "", "password123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldHash := user.PasswordHash
+
+	// A failed login never touches the hash
+	defaultScrypt.LogN = 11
+	authenticate(users, "alice", "wrong-password")
+	if u, _ := users.GetByID(user.ID); u.PasswordHash != oldHash {
+		t.Fatal("hash changed after a failed login")
+	}
+
+	if _, err := authenticate(users, "alice", "password123"); err != nil {
+		t.Fatal(err)
+	}
+	u, _ := users.GetByID(user.ID)
+	if !strings.HasPrefix(u.PasswordHash, "$scrypt$ln=11,") {
+		t.Fatalf("hash not upgraded: %q", u.PasswordHash)
+	}
+
+	// The upgraded hash still logs in, and isn't upgraded again
+	if _, err := authenticate(users, "alice", "password123"); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := users.GetByID(user.ID); again.PasswordHash != u.PasswordHash {
+		t.Error("hash rewritten although it was current")
+	}
+}
+
+// An unknown username must cost as much as a wrong password, or response
+// times would tell an attacker which accounts exist
+func TestAuthenticateUnknownUserDoesTheWork(t *testing.T) {
+	params, _, _, err := parsePasswordHash(dummyPasswordHash)
+	if err != nil {
+		t.Fatalf("dummy hash: %v", err)
+	}
+	if params != defaultScrypt {
+		t.Errorf("dummy hash uses %+v, logins use %+v", params, defaultScrypt)
+	}
+
+	users, _ := NewFileUserStore("")
+	hash, _ := hashPassword("password123")
+	users.Create(&User{Username: "alice", PasswordHash: hash})
+
+	timeOf := func(username string) time.Duration {
+		start := time.Now()
+		if _, err := authenticate(users, username, "wrong-password"); !errors.Is(err, ErrBadCredentials) {
+			t.Fatalf("%s: got %v", username, err)
+		}
+		return time.Since(start)
+	}
+	known, unknown := timeOf("alice"), timeOf("nobody")
+	// Generous bound: only skipping the hash entirely (~1000x faster) fails
+	if unknown < known/4 {
+		t.Errorf("unknown user took %v, known user %v", unknown, known)
+	}
+}
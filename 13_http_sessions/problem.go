@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ==========================================
+// ERRORS: RFC 7807 PROBLEM DETAILS
+// ==========================================
+// Every error response goes through writeProblem. API clients get
+//
+//   Content-Type: application/problem+json
+//   {"type": "about:blank", "title": "Not Found", "status": 404,
+//    "detail": "user not found", "instance": "/api/users/7"}
+//
+// while browsers (Accept: text/html) get the same information as a styled
+// page. Unknown errors and panics become a generic 500 that never leaks
+// internals; the real error goes to the log with the request ID.
+
+// Problem types with a meaning beyond the status code
+const (
+	problemValidation = "/problems/validation-error"
+	problemConflict   = "/problems/conflict"
+	problemCSRF       = "/problems/csrf"
+)
+
+// Problem is an error that knows how to present itself to clients
+type Problem struct {
+	Type      string      `json:"type"`
+	Title     string      `json:"title"`
+	Status    int         `json:"status"`
+	Detail    string      `json:"detail,omitempty"`
+	Instance  string      `json:"instance,omitempty"`
+	Errors    FieldErrors `json:"errors,omitempty"`     // Per-field messages
+	RequestID string      `json:"request_id,omitempty"` // For support / log lookup
+}
+
+// NewProblem makes a plain problem; the title is the status text
+func NewProblem(status int, detail string) *Problem {
+	return &Problem{Type: "about:blank", Title: http.StatusText(status), Status: status, Detail: detail}
+}
+
+// validationProblem reports bad input fields with a 400
+func validationProblem(errs FieldErrors) *Problem {
+	return &Problem{
+		Type:   problemValidation,
+		Title:  "Your request has invalid fields",
+		Status: http.StatusBadRequest,
+		Detail: "See errors for what to fix.",
+		Errors: errs,
+	}
+}
+
+func (p *Problem) Error() string {
+	if p.Detail == "" {
+		return p.Title
+	}
+	return p.Title + ": " + p.Detail
+}
+
+// writeError turns any error into a response: Problems as they are,
+// FieldErrors as a validation problem, anything else as a safe 500
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	var p *Problem
+	var fields FieldErrors
+	switch {
+	case errors.As(err, &p):
+	case errors.As(err, &fields):
+		p = validationProblem(fields)
+	default:
+		log.Printf("error [%s] %s %s: %v", requestID(r), r.Method, r.URL.Path, err)
+		p = internalProblem()
+	}
+	writeProblem(w, r, p)
+}
+
+// The only thing a client ever sees for an unexpected failure
+func internalProblem() *Problem {
+	return NewProblem(http.StatusInternalServerError, "Something went wrong on our side. Please try again later.")
+}
+
+// writeProblem sends p as problem+json or as an HTML page, whichever the
+// client prefers
+func writeProblem(w http.ResponseWriter, r *http.Request, p *Problem) {
+	out := *p // Don't modify a shared Problem value
+	if out.Instance == "" {
+		out.Instance = r.URL.Path
+	}
+	if out.RequestID == "" {
+		out.RequestID = requestID(r)
+	}
+
+	if prefersHTML(r) && renderer != nil {
+		renderer.RenderStatus(w, out.Status, "error", pageData{Problem: &out})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(out.Status)
+	if err := json.NewEncoder(w).Encode(out); err != nil {
+		log.Printf("writing problem response: %v", err)
+	}
+}
+
+// prefersHTML reports whether the Accept header ranks text/html above
+// JSON. Browsers do; curl (*/*) and fetch() with application/json don't.
+func prefersHTML(r *http.Request) bool {
+	htmlQ, jsonQ := -1.0, -1.0
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if s, ok := params["q"]; ok {
+			if f, err := strconv.ParseFloat(s, 64); err == nil {
+				q = f
+			}
+		}
+		switch mediaType {
+		case "text/html", "application/xhtml+xml":
+			htmlQ = max(htmlQ, q)
+		case "application/json", "application/problem+json":
+			jsonQ = max(jsonQ, q)
+		}
+	}
+	return htmlQ > 0 && htmlQ > jsonQ
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ==========================================
+// RATE LIMITING
+// ==========================================
+// Token bucket per client: every client starts with Limit tokens, each
+// request takes one, and tokens come back at Limit per Window. An empty
+// bucket means 429 Too Many Requests.
+//
+// Responses carry the IETF RateLimit headers so clients can slow down
+// before they hit the wall:
+//
+//   RateLimit-Limit: 10         RateLimit-Policy: 10;w=60
+//   RateLimit-Remaining: 3      RateLimit-Reset: 42   (seconds until full)
+//   Retry-After: 6              (only on 429)
+
+// Most buckets kept at once, so a flood of new clients can't eat memory.
+// Past that, new clients share the overflow bucket until room frees up.
+const (
+	maxRateBuckets = 100_000
+	overflowKey    = "overflow"
+)
+
+// RateLimitPolicy says how much a client may do
+type RateLimitPolicy struct {
+	Name   string
+	Limit  int // Requests per Window (also the burst size)
+	Window time.Duration
+	Key    func(r *http.Request) string
+}
+
+// Parse "10/m", "100/h", "5/10s". "off" or "" disables the limit (nil).
+func parseRatePolicy(name, spec string, key func(*http.Request) string) (*RateLimitPolicy, error) {
+	if spec == "" || spec == "off" || spec == "0" {
+		return nil, nil
+	}
+	count, per, ok := strings.Cut(spec, "/")
+	n, err := strconv.Atoi(count)
+	if !ok || err != nil || n < 1 {
+		return nil, fmt.Errorf("rate limit %s: %q is not like 10/m", name, spec)
+	}
+	if per != "" && (per[0] < '0' || per[0] > '9') {
+		per = "1" + per // "m" -> "1m"
+	}
+	window, err := time.ParseDuration(per)
+	if err != nil || window <= 0 {
+		return nil, fmt.Errorf("rate limit %s: bad window in %q", name, spec)
+	}
+	return &RateLimitPolicy{Name: name, Limit: n, Window: window, Key: key}, nil
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter applies one policy; use one per route group
+type RateLimiter struct {
+	policy    RateLimitPolicy
+	rate      float64 // Tokens per second
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time // Last eviction forced by a full map
+}
+
+func NewRateLimiter(policy RateLimitPolicy) *RateLimiter {
+	return &RateLimiter{
+		policy:  policy,
+		rate:    float64(policy.Limit) / policy.Window.Seconds(),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// rateResult is what one request learned about its bucket
+type rateResult struct {
+	allowed    bool
+	remaining  int
+	reset      time.Duration // Until the bucket is full again
+	retryAfter time.Duration // Until the next token (0 if allowed)
+}
+
+// take spends one token from key's bucket if there is one
+func (l *RateLimiter) take(key string, now time.Time) rateResult {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	burst := float64(l.policy.Limit)
+	b, ok := l.buckets[key]
+	if !ok && len(l.buckets) >= maxRateBuckets {
+		// Sweeping is O(n), so at most once a second. Dropping someone's
+		// half-empty bucket would reset their limit: if nothing has
+		// refilled, the newcomer goes in the shared overflow bucket.
+		if now.Sub(l.lastSweep) >= time.Second {
+			l.evictLocked(now)
+			l.lastSweep = now
+		}
+		if len(l.buckets) >= maxRateBuckets {
+			key = overflowKey
+			b, ok = l.buckets[key]
+		}
+	}
+	if !ok {
+		b = &bucket{tokens: burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	res := rateResult{}
+	if b.tokens >= 1 {
+		b.tokens--
+		res.allowed = true
+	} else {
+		res.retryAfter = l.secondsFor(1 - b.tokens)
+	}
+	res.remaining = int(b.tokens)
+	res.reset = l.secondsFor(burst - b.tokens)
+	return res
+}
+
+func (l *RateLimiter) secondsFor(tokens float64) time.Duration {
+	return time.Duration(tokens / l.rate * float64(time.Second))
+}
+
+// evictLocked drops buckets that have refilled completely: a new bucket
+// would look the same
+func (l *RateLimiter) evictLocked(now time.Time) int {
+	burst := float64(l.policy.Limit)
+	removed := 0
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= burst {
+			delete(l.buckets, key)
+			removed++
+		}
+	}
+	return removed
+}
+
+// startEvictor cleans idle buckets every interval until ctx is cancelled
+func (l *RateLimiter) startEvictor(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				l.mu.Lock()
+				l.evictLocked(now)
+				l.mu.Unlock()
+			}
+		}
+	}()
+}
+
+// Middleware rejects requests over the limit with 429
+func (l *RateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		res := l.take(l.policy.Key(r), time.Now())
+
+		h := w.Header()
+		h.Set("RateLimit-Limit", strconv.Itoa(l.policy.Limit))
+		h.Set("RateLimit-Remaining", strconv.Itoa(res.remaining))
+		h.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(res.reset)))
+		h.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", l.policy.Limit, ceilSeconds(l.policy.Window)))
+
+		if !res.allowed {
+			h.Set("Retry-After", strconv.Itoa(ceilSeconds(res.retryAfter)))
+			writeProblem(w, r, NewProblem(http.StatusTooManyRequests,
+				fmt.Sprintf("Too many requests, try again in %d seconds.", ceilSeconds(res.retryAfter))))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rateLimit builds a limiter for policy, or a no-op when it's off (nil)
+func rateLimit(ctx context.Context, policy *RateLimitPolicy) Middleware {
+	if policy == nil {
+		return func(next http.Handler) http.Handler { return next }
+	}
+	l := NewRateLimiter(*policy)
+	l.startEvictor(ctx, time.Minute)
+	return l.Middleware
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// ==========================================
+// RATE LIMIT KEYS
+// ==========================================
+
+// clientIP is the address the request came from. Behind a reverse proxy
+// every client shares the proxy's address, so limit in the proxy there.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr // Unix sockets have no port (often no address)
+	}
+	return host
+}
+
+// rateKeyIP limits per client IP address
+func rateKeyIP(r *http.Request) string {
+	return "ip:" + clientIP(r)
+}
+
+// rateKeyClient limits per API token, else per logged-in user (cookie or
+// JWT), else per IP. A user gets one budget on all their devices. It runs
+// after bearerAuth and only trusts what it verified: a made-up token
+// counts against its IP, so sending a new one each time gains nothing.
+func rateKeyClient(r *http.Request) string {
+	if token := requestToken(r); token != nil {
+		return "token:" + token.ID
+	}
+	if r.Context().Value(bearerErrCtxKey{}) == nil {
+		if session := currentSession(r); session != nil {
+			return "user:" + strings.ToLower(session.Username)
+		}
+	}
+	return rateKeyIP(r)
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseRatePolicy(t *testing.T) {
+	tests := []struct {
+		spec   string
+		limit  int
+		window time.Duration
+		err    bool
+	}{
+		{"10/m", 10, time.Minute, false},
+		{"100/h", 100, time.Hour, false},
+		{"5/10s", 5, 10 * time.Second, false},
+		{"off", 0, 0, false},
+		{"", 0, 0, false},
+		{"ten/m", 0, 0, true},
+		{"0/m", 0, 0, true},
+		{"10", 0, 0, true},
+		{"10/fortnight", 0, 0, true},
+		{"10/-1s", 0, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			p, err := parseRatePolicy("test", tt.spec, rateKeyIP)
+			if tt.err {
+				if err == nil {
+					t.Errorf("expected an error, got %+v", p)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.limit == 0 {
+				if p != nil {
+					t.Errorf("want no policy, got %+v", p)
+				}
+				return
+			}
+			if p.Limit != tt.limit || p.Window != tt.window {
+				t.Errorf("got %d per %v", p.Limit, p.Window)
+			}
+		})
+	}
+}
+
+func TestRateLimiterRefill(t *testing.T) {
+	// 6 per minute: one token back every 10 seconds
+	l := NewRateLimiter(RateLimitPolicy{Limit: 6, Window: time.Minute})
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) time.Time { return start.Add(d) }
+
+	steps := []struct {
+		at         time.Duration
+		allowed    bool
+		remaining  int
+		reset      time.Duration
+		retryAfter time.Duration
+	}{
+		{0, true, 5, 10 * time.Second, 0},
+		{0, true, 4, 20 * time.Second, 0},
+		{0, true, 3, 30 * time.Second, 0},
+		{0, true, 2, 40 * time.Second, 0},
+		{0, true, 1, 50 * time.Second, 0},
+		{0, true, 0, 60 * time.Second, 0},
+		{0, false, 0, 60 * time.Second, 10 * time.Second},
+		{5 * time.Second, false, 0, 55 * time.Second, 5 * time.Second}, // Half a token back
+		{10 * time.Second, true, 0, 60 * time.Second, 0},
+		{35 * time.Second, true, 1, 45 * time.Second, 0}, // 2.5 back, one spent: 1.5 left
+		{10 * time.Minute, true, 5, 10 * time.Second, 0}, // Capped at the burst
+	}
+	for i, s := range steps {
+		res := l.take("k", at(s.at))
+		if res.allowed != s.allowed || res.remaining != s.remaining || res.reset != s.reset || res.retryAfter != s.retryAfter {
+			t.Errorf("step %d at %v: got %+v, want %+v", i, s.at, res,
+				rateResult{s.allowed, s.remaining, s.reset, s.retryAfter})
+		}
+	}
+
+	// Buckets are per key
+	if res := l.take("other", at(0)); !res.allowed || res.remaining != 5 {
+		t.Errorf("second key: %+v", res)
+	}
+}
+
+func TestRateLimiterBucketCap(t *testing.T) {
+	l := NewRateLimiter(RateLimitPolicy{Limit: 2, Window: time.Minute})
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// Fill the map with clients that each spent a token
+	for i := range maxRateBuckets {
+		l.take(fmt.Sprint("client-", i), now)
+	}
+	if len(l.buckets) != maxRateBuckets {
+		t.Fatalf("%d buckets", len(l.buckets))
+	}
+
+	// Nobody has refilled, so newcomers share the overflow bucket
+	// instead of resetting an existing client's limit
+	if res := l.take("new-1", now); !res.allowed || res.remaining != 1 {
+		t.Errorf("first newcomer: %+v", res)
+	}
+	if res := l.take("new-2", now); !res.allowed || res.remaining != 0 {
+		t.Errorf("second newcomer: %+v", res)
+	}
+	if res := l.take("new-3", now); res.allowed {
+		t.Errorf("overflow bucket should be empty: %+v", res)
+	}
+	if _, ok := l.buckets["new-1"]; ok {
+		t.Error("newcomer got its own bucket past the cap")
+	}
+	// Existing clients keep their own budget
+	if res := l.take("client-7", now); !res.allowed || res.remaining != 0 {
+		t.Errorf("existing client: %+v", res)
+	}
+
+	// Once the old buckets have refilled they are swept and make room
+	later := now.Add(time.Minute)
+	if res := l.take("new-4", later); !res.allowed || res.remaining != 1 {
+		t.Errorf("after refill: %+v", res)
+	}
+	if _, ok := l.buckets["new-4"]; !ok || len(l.buckets) > 10 {
+		t.Errorf("not swept: %d buckets", len(l.buckets))
+	}
+}
+
+func TestRateLimiterEvict(t *testing.T) {
+	l := NewRateLimiter(RateLimitPolicy{Limit: 10, Window: 10 * time.Second})
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	l.take("light", now) // Back to full after 1s
+	for range 5 {
+		l.take("heavy", now) // Back to full after 5s
+	}
+
+	if n := l.evictLocked(now.Add(500 * time.Millisecond)); n != 0 {
+		t.Errorf("evicted %d buckets still refilling", n)
+	}
+	if n := l.evictLocked(now.Add(time.Second)); n != 1 {
+		t.Errorf("evicted %d, want only the full one", n)
+	}
+	if _, ok := l.buckets["heavy"]; !ok {
+		t.Error("half-empty bucket evicted")
+	}
+	if n := l.evictLocked(now.Add(5 * time.Second)); n != 1 || len(l.buckets) != 0 {
+		t.Errorf("evicted %d, %d left", n, len(l.buckets))
+	}
+}
+
+func TestRateLimiterMiddleware(t *testing.T) {
+	l := NewRateLimiter(RateLimitPolicy{Limit: 2, Window: time.Minute, Key: rateKeyIP})
+	h := l.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	var w *httptest.ResponseRecorder
+	for range 3 {
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	}
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("third request: %d", w.Code)
+	}
+	want := map[string]string{
+		"RateLimit-Limit":     "2",
+		"RateLimit-Remaining": "0",
+		"RateLimit-Reset":     "60",
+		"RateLimit-Policy":    "2;w=60",
+		"Retry-After":         "30",
+	}
+	for name, value := range want {
+		if got := w.Header().Get(name); got != value {
+			t.Errorf("%s: %q, want %q", name, got, value)
+		}
+	}
+}
+
+func TestRateKeyClient(t *testing.T) {
+	with := func(r *http.Request, key, value any) *http.Request {
+		return r.WithContext(context.WithValue(r.Context(), key, value))
+	}
+	request := func() *http.Request {
+		r := httptest.NewRequest("GET", "/api/users", nil)
+		r.RemoteAddr = "192.0.2.7:51000"
+		return r
+	}
+	alice := &Session{Username: "Alice"}
+	token := &APIToken{ID: "t1"}
+	failed := &bearerFailure{}
+
+	tests := []struct {
+		name string
+		r    *http.Request
+		want string
+	}{
+		{"anonymous", request(), "ip:192.0.2.7"},
+		{"logged in", with(request(), sessionCtxKey{}, alice), "user:alice"},
+		{"API token", with(request(), apiTokenCtxKey{}, token), "token:t1"},
+		{"token beats user", with(with(request(), sessionCtxKey{}, alice), apiTokenCtxKey{}, token), "token:t1"},
+		// A made-up bearer token counts against the IP, even with a cookie
+		{"bad bearer", with(request(), bearerErrCtxKey{}, failed), "ip:192.0.2.7"},
+		{"bad bearer and cookie", with(with(request(), sessionCtxKey{}, alice), bearerErrCtxKey{}, failed), "ip:192.0.2.7"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rateKeyClient(tt.r); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	unix := request()
+	unix.RemoteAddr = "@"
+	if got := rateKeyIP(unix); got != "ip:@" {
+		t.Errorf("unix socket: %q", got)
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// ==========================================
+// ROUTER
+// ==========================================
+// A small router on top of net/http:
+//   - routes match on method + path:   r.Get("/api/users/{id}", h)
+//   - {name} segments become path values, read with r.PathValue("id")
+//   - groups share a prefix and middleware (see middleware.go)
+//   - unknown paths get 404, known paths with the wrong method get 405
+//     and an Allow header listing the methods that would work
+
+type route struct {
+	method   string
+	pattern  string
+	segments []string
+	handler  http.Handler
+}
+
+// RouteInfo describes one registered route, for debugging
+type RouteInfo struct {
+	Method  string
+	Pattern string
+}
+
+type Router struct {
+	routes     []*route
+	middleware []Middleware // Run for every request, even 404s
+	chain      http.Handler // middleware wrapped around dispatch
+
+	NotFound         http.HandlerFunc
+	MethodNotAllowed http.HandlerFunc // Allow header is already set when called
+}
+
+func NewRouter() *Router {
+	rt := &Router{
+		NotFound: func(w http.ResponseWriter, r *http.Request) {
+			writeProblem(w, r, NewProblem(http.StatusNotFound, "No page or endpoint at "+r.URL.Path))
+		},
+		MethodNotAllowed: func(w http.ResponseWriter, r *http.Request) {
+			writeProblem(w, r, NewProblem(http.StatusMethodNotAllowed,
+				r.Method+" is not supported here, use one of: "+w.Header().Get("Allow")))
+		},
+	}
+	rt.chain = http.HandlerFunc(rt.dispatch)
+	return rt
+}
+
+// Use adds middleware that runs around every request
+func (rt *Router) Use(mw ...Middleware) {
+	rt.middleware = append(rt.middleware, mw...)
+	rt.chain = Chain(rt.middleware...)(http.HandlerFunc(rt.dispatch))
+}
+
+// Handle registers a handler for method + pattern
+func (rt *Router) Handle(method, pattern string, h http.HandlerFunc) {
+	rt.handle(method, pattern, h)
+}
+
+func (rt *Router) handle(method, pattern string, h http.Handler) {
+	if !strings.HasPrefix(pattern, "/") {
+		panic("router: pattern must start with '/': " + pattern)
+	}
+	for _, existing := range rt.routes {
+		if existing.method == method && existing.pattern == pattern {
+			panic(fmt.Sprintf("router: %s %s registered twice", method, pattern))
+		}
+	}
+	rt.routes = append(rt.routes, &route{
+		method:   method,
+		pattern:  pattern,
+		segments: splitPath(pattern),
+		handler:  h,
+	})
+}
+
+func (rt *Router) Get(pattern string, h http.HandlerFunc)    { rt.Handle("GET", pattern, h) }
+func (rt *Router) Post(pattern string, h http.HandlerFunc)   { rt.Handle("POST", pattern, h) }
+func (rt *Router) Put(pattern string, h http.HandlerFunc)    { rt.Handle("PUT", pattern, h) }
+func (rt *Router) Patch(pattern string, h http.HandlerFunc)  { rt.Handle("PATCH", pattern, h) }
+func (rt *Router) Delete(pattern string, h http.HandlerFunc) { rt.Handle("DELETE", pattern, h) }
+
+// Group returns a sub-router: its routes get prefix in front and mw around them
+func (rt *Router) Group(prefix string, mw ...Middleware) *Group {
+	return &Group{router: rt, prefix: strings.TrimSuffix(prefix, "/"), middleware: mw}
+}
+
+// Routes lists everything registered, sorted by path then method
+func (rt *Router) Routes() []RouteInfo {
+	list := make([]RouteInfo, 0, len(rt.routes))
+	for _, r := range rt.routes {
+		list = append(list, RouteInfo{Method: r.method, Pattern: r.pattern})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Pattern != list[j].Pattern {
+			return list[i].Pattern < list[j].Pattern
+		}
+		return list[i].Method < list[j].Method
+	})
+	return list
+}
+
+// Plain-text route table, handy at /debug/routes
+func (rt *Router) routesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, info := range rt.Routes() {
+		fmt.Fprintf(w, "%-7s %s\n", info.Method, info.Pattern)
+	}
+}
+
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rt.chain.ServeHTTP(w, r)
+}
+
+// Find the route for this request and call it
+func (rt *Router) dispatch(w http.ResponseWriter, r *http.Request) {
+	path := splitPath(r.URL.Path)
+
+	var best *route
+	var bestParams map[string]string
+	allowed := map[string]bool{}
+
+	for _, candidate := range rt.routes {
+		params, ok := matchPath(candidate.segments, path)
+		if !ok {
+			continue
+		}
+		allowed[candidate.method] = true
+		if candidate.method == "GET" {
+			allowed["HEAD"] = true
+		}
+
+		method := r.Method
+		if method == "HEAD" {
+			method = "GET" // net/http drops the body for HEAD
+		}
+		if candidate.method != method {
+			continue
+		}
+		// Prefer the route with fewer parameters: /users/me beats /users/{id}
+		if best == nil || len(params) < len(bestParams) {
+			best, bestParams = candidate, params
+		}
+	}
+
+	if best != nil {
+		noteRoute(r, best.pattern)
+		for name, value := range bestParams {
+			r.SetPathValue(name, value)
+		}
+		best.handler.ServeHTTP(w, r)
+		return
+	}
+
+	if len(allowed) == 0 {
+		rt.NotFound(w, r)
+		return
+	}
+
+	allowed["OPTIONS"] = true
+	methods := make([]string, 0, len(allowed))
+	for m := range allowed {
+		methods = append(methods, m)
+	}
+	sort.Strings(methods)
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	rt.MethodNotAllowed(w, r)
+}
+
+// "/api/users/{id}" -> ["api", "users", "{id}"], "/" -> []
+func splitPath(p string) []string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+// Match path segments against a pattern, collecting {name} values
+func matchPath(pattern, path []string) (map[string]string, bool) {
+	if len(pattern) != len(path) {
+		return nil, false
+	}
+	var params map[string]string
+	for i, seg := range pattern {
+		if strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}") {
+			if path[i] == "" {
+				return nil, false
+			}
+			if params == nil {
+				params = map[string]string{}
+			}
+			params[seg[1:len(seg)-1]] = path[i]
+			continue
+		}
+		if seg != path[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+// ==========================================
+// ROUTE GROUPS
+// ==========================================
+
+type Group struct {
+	router     *Router
+	prefix     string
+	middleware []Middleware
+}
+
+// Group nests a group: prefixes add up, parent middleware runs first
+func (g *Group) Group(prefix string, mw ...Middleware) *Group {
+	all := append(append([]Middleware{}, g.middleware...), mw...)
+	return &Group{router: g.router, prefix: g.prefix + strings.TrimSuffix(prefix, "/"), middleware: all}
+}
+
+func (g *Group) Handle(method, pattern string, h http.HandlerFunc) {
+	full := g.prefix + pattern
+	if pattern == "/" && g.prefix != "" {
+		full = g.prefix
+	}
+	g.router.handle(method, full, Chain(g.middleware...)(h))
+}
+
+func (g *Group) Get(pattern string, h http.HandlerFunc)    { g.Handle("GET", pattern, h) }
+func (g *Group) Post(pattern string, h http.HandlerFunc)   { g.Handle("POST", pattern, h) }
+func (g *Group) Put(pattern string, h http.HandlerFunc)    { g.Handle("PUT", pattern, h) }
+func (g *Group) Patch(pattern string, h http.HandlerFunc)  { g.Handle("PATCH", pattern, h) }
+func (g *Group) Delete(pattern string, h http.HandlerFunc) { g.Handle("DELETE", pattern, h) }
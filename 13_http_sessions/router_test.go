@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Handler that reports which route ran and the path values it saw
+func routeEcho(name string, params ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, name)
+		for _, p := range params {
+			fmt.Fprintf(w, " %s=%s", p, r.PathValue(p))
+		}
+	}
+}
+
+func TestRouterDispatch(t *testing.T) {
+	rt := NewRouter()
+	rt.Get("/", routeEcho("home"))
+	rt.Get("/users", routeEcho("list"))
+	rt.Post("/users", routeEcho("create"))
+	rt.Get("/users/{id}", routeEcho("show", "id"))
+	rt.Get("/users/me", routeEcho("me"))
+	rt.Delete("/users/{id}", routeEcho("delete", "id"))
+	rt.Get("/users/{id}/posts/{post}", routeEcho("post", "id", "post"))
+	rt.Get("/{a}/{b}", routeEcho("two", "a", "b"))
+	rt.Get("/files/{name}", routeEcho("file", "name"))
+
+	tests := []struct {
+		method, path string
+		status       int
+		body         string // Prefix of the body
+		allow        string
+	}{
+		{"GET", "/", 200, "home", ""},
+		{"GET", "/users", 200, "list", ""},
+		{"GET", "/users/", 200, "list", ""}, // Trailing slash ignored
+		{"POST", "/users", 200, "create", ""},
+		{"GET", "/users/42", 200, "show id=42", ""},
+		{"DELETE", "/users/42", 200, "delete id=42", ""},
+		{"GET", "/users/42/posts/7", 200, "post id=42 post=7", ""},
+
+		// Fewest parameters wins, whatever the registration order
+		{"GET", "/users/me", 200, "me", ""},
+		{"GET", "/files/a", 200, "file name=a", ""},
+		{"GET", "/x/y", 200, "two a=x b=y", ""},
+
+		// HEAD runs the GET handler
+		{"HEAD", "/users/42", 200, "", ""},
+
+		{"GET", "/nope", 404, "", ""},
+		{"GET", "/users/42/posts", 404, "", ""},
+		{"GET", "/users//posts/7", 404, "", ""}, // Empty segment isn't a value
+
+		// Known path, wrong method
+		{"PUT", "/users", 405, "", "GET, HEAD, OPTIONS, POST"},
+		{"POST", "/users/me", 405, "", "DELETE, GET, HEAD, OPTIONS"},
+		{"PATCH", "/users/42", 405, "", "DELETE, GET, HEAD, OPTIONS"},
+
+		// OPTIONS is answered automatically
+		{"OPTIONS", "/users", 204, "", "GET, HEAD, OPTIONS, POST"},
+		{"OPTIONS", "/", 204, "", "GET, HEAD, OPTIONS"},
+		{"OPTIONS", "/nope", 404, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			rt.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d (%s)", w.Code, tt.status, w.Body)
+			}
+			if tt.status == 200 && tt.method != "HEAD" && w.Body.String() != tt.body {
+				t.Errorf("body %q, want %q", w.Body, tt.body)
+			}
+			if got := w.Header().Get("Allow"); got != tt.allow {
+				t.Errorf("Allow %q, want %q", got, tt.allow)
+			}
+		})
+	}
+}
+
+func TestRouterGroups(t *testing.T) {
+	var trace []string
+	mark := func(name string) Middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				trace = append(trace, name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+
+	rt := NewRouter()
+	rt.Use(mark("global"))
+	api := rt.Group("/api/", mark("api"))
+	api.Get("/", routeEcho("api root"))
+	api.Get("/status", routeEcho("status"))
+	admin := api.Group("/admin", mark("admin"))
+	admin.Delete("/users/{id}", routeEcho("admin delete", "id"))
+	rt.Get("/plain", routeEcho("plain"))
+
+	tests := []struct {
+		method, path string
+		body         string
+		trace        string
+	}{
+		{"GET", "/api", "api root", "global api"},
+		{"GET", "/api/status", "status", "global api"},
+		{"DELETE", "/api/admin/users/3", "admin delete id=3", "global api admin"},
+		{"GET", "/plain", "plain", "global"},
+		{"GET", "/missing", "", "global"}, // Global middleware sees 404s too
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			trace = nil
+			w := httptest.NewRecorder()
+			rt.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+			if tt.body != "" && w.Body.String() != tt.body {
+				t.Errorf("body %q, want %q", w.Body, tt.body)
+			}
+			if got := strings.Join(trace, " "); got != tt.trace {
+				t.Errorf("middleware ran %q, want %q", got, tt.trace)
+			}
+		})
+	}
+
+	want := []RouteInfo{
+		{"GET", "/api"},
+		{"DELETE", "/api/admin/users/{id}"},
+		{"GET", "/api/status"},
+		{"GET", "/plain"},
+	}
+	if got := rt.Routes(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Routes() = %v, want %v", got, want)
+	}
+}
+
+func TestRouterRegistrationPanics(t *testing.T) {
+	tests := map[string]func(rt *Router){
+		"no leading slash": func(rt *Router) { rt.Get("users", routeEcho("x")) },
+		"duplicate": func(rt *Router) {
+			rt.Get("/users", routeEcho("x"))
+			rt.Get("/users", routeEcho("y"))
+		},
+		"duplicate through a group": func(rt *Router) {
+			rt.Get("/api/users", routeEcho("x"))
+			rt.Group("/api").Get("/users", routeEcho("y"))
+		},
+	}
+	for name, register := range tests {
+		t.Run(name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Error("expected a panic")
+				}
+			}()
+			register(NewRouter())
+		})
+	}
+}
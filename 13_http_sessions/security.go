@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ==========================================
+// COOKIES
+// ==========================================
+// Every cookie we set goes through newCookie, so the attributes are the
+// same everywhere:
+//
+//   HttpOnly        scripts can't read it (XSS can't steal the session)
+//   SameSite=Lax    not sent on cross-site POSTs (a second CSRF defence)
+//   Secure          only sent over HTTPS (on with -tls or -cookie-secure)
+//   __Host- prefix  with Secure: the browser refuses the cookie unless it
+//                   is Secure, has Path=/ and no Domain, so a subdomain
+//                   can't plant one for us
+
+// Cookie names, prefixed by hardenCookies when cookies are Secure
+var (
+	sessionCookieName  = "session_id"
+	csrfSeedCookieName = "csrf_seed"
+
+	cookieSecure   bool
+	cookieSameSite = http.SameSiteLaxMode
+)
+
+// hardenCookies turns on Secure (and with it the __Host- names)
+func hardenCookies(secure bool, sameSite string) error {
+	switch strings.ToLower(sameSite) {
+	case "lax":
+		cookieSameSite = http.SameSiteLaxMode
+	case "strict":
+		cookieSameSite = http.SameSiteStrictMode
+	default:
+		return fmt.Errorf("unknown SameSite mode %q (want lax or strict)", sameSite)
+	}
+	cookieSecure = secure
+	if secure {
+		sessionCookieName = "__Host-session_id"
+		csrfSeedCookieName = "__Host-csrf_seed"
+	}
+	return nil
+}
+
+// newCookie builds a cookie with our attributes. maxAge < 0 deletes it,
+// 0 makes it last until the browser closes.
+func newCookie(name, value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   cookieSecure,
+		SameSite: cookieSameSite,
+	}
+}
+
+// ==========================================
+// SECURITY HEADERS
+// ==========================================
+
+// Pages only load things from this server. Inline styles stay allowed
+// for the templates' <style> block; scripts must be files from /static/,
+// never inline. connect-src lets chat.js open its WebSocket.
+const contentSecurityPolicy = "default-src 'self'; script-src 'self'; connect-src 'self'; style-src 'self' 'unsafe-inline'; " +
+	"img-src 'self' data:; base-uri 'self'; form-action 'self'; frame-ancestors 'none'"
+
+// securityHeaders sets the usual hardening headers on every response.
+// HSTS only goes out over HTTPS: browsers ignore it on plain HTTP anyway.
+func securityHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("Content-Security-Policy", contentSecurityPolicy)
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("X-Frame-Options", "DENY") // frame-ancestors for old browsers
+		h.Set("Referrer-Policy", "strict-origin-when-cross-origin")
+		h.Set("Cross-Origin-Opener-Policy", "same-origin")
+		if r.TLS != nil {
+			h.Set("Strict-Transport-Security", "max-age=31536000; includeSubDomains")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ==========================================
+// TLS
+// ==========================================
+//   -tls-cert=cert.pem -tls-key=key.pem   use these files
+//   -tls                                  self-signed dev certificate,
+//                                         made once and kept in -tls-dir
+
+// tlsConfig loads or creates the certificate
+func tlsConfig(certFile, keyFile, devDir string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" {
+		var err error
+		certFile, keyFile, err = devCertificate(devDir)
+		if err != nil {
+			return nil, err
+		}
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   []string{"h2", "http/1.1"},
+	}, nil
+}
+
+// devCertificate returns the dev cert in dir, making a new one if it's
+// missing or about to expire. Browsers will warn: it's self-signed.
+func devCertificate(dir string) (certFile, keyFile string, err error) {
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	if cert, err := tls.LoadX509KeyPair(certFile, keyFile); err == nil &&
+		time.Until(cert.Leaf.NotAfter) > 7*24*time.Hour {
+		return certFile, keyFile, nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return "", "", err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{Organization: []string{"Go HTTP Session Demo (development)"}},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return "", "", err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return "", "", err
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", "", err
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		return "", "", err
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		return "", "", err
+	}
+	log.Printf("Created self-signed development certificate in %s", dir)
+	return certFile, keyFile, nil
+}
+
+// ==========================================
+// HTTP -> HTTPS REDIRECT
+// ==========================================
+
+// httpsRedirect sends plain-HTTP visitors to the same URL over HTTPS.
+// httpsPort is where the TLS listener is, "" or "443" for the default.
+func httpsRedirect(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if host == "" {
+			http.Error(w, "Use HTTPS", http.StatusBadRequest)
+			return
+		}
+		if httpsPort != "" && httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		}
+		// 308 keeps the method and body, unlike 301
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
+
+// startHTTPSRedirect serves httpsRedirect on addr until shutdown
+func startHTTPSRedirect(addr string, tlsLn net.Listener) {
+	_, port, err := net.SplitHostPort(tlsLn.Addr().String())
+	if err != nil {
+		log.Fatal("-http-redirect-addr needs a TCP address for -addr")
+	}
+	ln, err := listen(addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	srv := &http.Server{Handler: httpsRedirect(port), ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("http redirect: %v", err)
+		}
+	}()
+	onShutdown("stop http redirect", srv.Shutdown)
+	log.Printf("Redirecting %s to HTTPS", listenURL(ln, false))
+}
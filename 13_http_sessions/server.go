@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ==========================================
+// LISTENERS
+// ==========================================
+// -addr accepts three forms:
+//
+//   :8080 / 127.0.0.1:8080    TCP
+//   unix:/run/demo.sock       Unix domain socket
+//   systemd                   socket handed over by systemd (socket activation)
+
+// First file descriptor systemd passes (0-2 are stdin/out/err)
+const systemdFirstFD = 3
+
+// listen opens the listener described by addr
+func listen(addr string) (net.Listener, error) {
+	switch {
+	case addr == "systemd":
+		return systemdListener()
+	case strings.HasPrefix(addr, "unix:"):
+		path := strings.TrimPrefix(addr, "unix:")
+		// A socket file left by a crashed run would make Listen fail
+		if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(path)
+		}
+		return net.Listen("unix", path)
+	default:
+		return net.Listen("tcp", addr)
+	}
+}
+
+// systemdListener picks up the socket systemd opened for us. systemd sets
+// LISTEN_PID to our PID and LISTEN_FDS to the number of sockets passed.
+func systemdListener() (net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, errors.New("systemd: LISTEN_PID not set for this process (not socket-activated?)")
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, errors.New("systemd: no sockets passed in LISTEN_FDS")
+	}
+	// Don't let child processes think the sockets are meant for them
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	f := os.NewFile(uintptr(systemdFirstFD), "systemd-socket")
+	defer f.Close() // FileListener dups the descriptor
+	return net.FileListener(f)
+}
+
+// Human-friendly address for the startup banner
+func listenURL(ln net.Listener, secure bool) string {
+	if ln.Addr().Network() == "unix" {
+		return "unix:" + ln.Addr().String()
+	}
+	host, port, err := net.SplitHostPort(ln.Addr().String())
+	if err != nil {
+		return ln.Addr().String()
+	}
+	if host == "" || host == "::" || host == "0.0.0.0" {
+		host = "localhost"
+	}
+	scheme := "http://"
+	if secure {
+		scheme = "https://"
+	}
+	return scheme + net.JoinHostPort(host, port)
+}
+
+// Default for -addr: $ADDR, else :$PORT, else :8080
+func defaultAddr() string {
+	if addr := os.Getenv("ADDR"); addr != "" {
+		return addr
+	}
+	if port := os.Getenv("PORT"); port != "" {
+		return ":" + port
+	}
+	return ":8080"
+}
+
+// ==========================================
+// SHUTDOWN HOOKS
+// ==========================================
+
+type shutdownHook struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+var (
+	hooksMu       sync.Mutex
+	shutdownHooks []shutdownHook
+)
+
+// onShutdown registers work to do after the server stops accepting
+// requests, like flushing the session store. Hooks run in reverse order,
+// like defer: the access log, opened first, is closed last, after
+// everything that might still write to it.
+func onShutdown(name string, fn func(ctx context.Context) error) {
+	hooksMu.Lock()
+	defer hooksMu.Unlock()
+	shutdownHooks = append(shutdownHooks, shutdownHook{name, fn})
+}
+
+func runShutdownHooks(ctx context.Context) {
+	hooksMu.Lock()
+	hooks := append([]shutdownHook{}, shutdownHooks...)
+	hooksMu.Unlock()
+
+	for _, h := range slices.Backward(hooks) {
+		if err := h.fn(ctx); err != nil {
+			log.Printf("shutdown: %s: %v", h.name, err)
+		}
+	}
+}
+
+// ==========================================
+// SERVE WITH GRACEFUL SHUTDOWN
+// ==========================================
+
+// serve runs srv on ln until ctx is cancelled (Ctrl+C / SIGTERM), then
+// marks the server not ready, waits readyDelay so load balancers see
+// /readyz fail, stops accepting connections, waits up to drain for
+// in-flight requests, and runs the shutdown hooks
+func serve(ctx context.Context, srv *http.Server, ln net.Listener, readyDelay, drain time.Duration) error {
+	errc := make(chan error, 1)
+	go func() { errc <- srv.Serve(ln) }()
+
+	select {
+	case err := <-errc:
+		return err // Couldn't serve at all
+	case <-ctx.Done():
+	}
+
+	shuttingDown.Store(true) // /readyz fails from now on (see health.go)
+	if readyDelay > 0 {
+		log.Printf("Not ready anymore, closing listeners in %v...", readyDelay)
+		time.Sleep(readyDelay)
+	}
+
+	log.Printf("Shutting down (waiting up to %v for requests to finish)...", drain)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), drain)
+	defer cancel()
+
+	err := srv.Shutdown(shutdownCtx)
+	if err != nil {
+		log.Printf("shutdown: %v, closing remaining connections", err)
+		srv.Close()
+	}
+
+	// Hooks get their own deadline, even if draining used it all up
+	hookCtx, cancelHooks := context.WithTimeout(context.Background(), drain)
+	defer cancelHooks()
+	runShutdownHooks(hookCtx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("requests still running after %v", drain)
+	}
+	return err
+}
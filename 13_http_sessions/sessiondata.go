@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ==========================================
+// SESSION DATA
+// ==========================================
+// Session.Data holds JSON text per key, so any value that survives
+// json.Marshal can be stored: strings, numbers, slices, structs...
+//
+//   sessionSet(w, r, "theme", "dark")
+//   theme, ok, err := SessionGet[string](session, "theme")
+//
+// Changes go through updateSession, which does read-change-save in one
+// step (store.Modify), so two tabs saving at once don't lose a write.
+// In cookie mode the cookie is re-issued instead, and the last response
+// the browser sees wins.
+
+// Limits keep sessions (and session cookies) small
+const (
+	maxSessionKeys    = 32
+	maxSessionKeyLen  = 64
+	maxSessionDataLen = 4096 // Bytes of JSON per value
+)
+
+// Keys starting with "_" are used by the server itself (like flashes)
+// and can't be touched through /api/session
+const flashKey = "_flash"
+
+var ErrNoSession = errors.New("no session")
+
+// SessionGet decodes the value under key into a T
+func SessionGet[T any](s *Session, key string) (T, bool, error) {
+	var v T
+	raw, ok := s.Data[key]
+	if !ok {
+		return v, false, nil
+	}
+	if err := json.Unmarshal([]byte(raw), &v); err != nil {
+		return v, true, fmt.Errorf("session value %q: %w", key, err)
+	}
+	return v, true, nil
+}
+
+// setData stores v as JSON under key, checking the limits
+func (s *Session) setData(key string, v any) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if len(raw) > maxSessionDataLen {
+		return FieldErrors{key: fmt.Sprintf("must be at most %d bytes of JSON", maxSessionDataLen)}
+	}
+	if _, exists := s.Data[key]; !exists && len(s.Data) >= maxSessionKeys {
+		return FieldErrors{key: fmt.Sprintf("session already holds %d keys", maxSessionKeys)}
+	}
+	if s.Data == nil {
+		s.Data = make(map[string]string)
+	}
+	s.Data[key] = string(raw)
+	return nil
+}
+
+// updateSession applies fn to the current request's session and saves it
+func updateSession(w http.ResponseWriter, r *http.Request, fn func(*Session) error) (*Session, error) {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return nil, ErrNoSession
+	}
+
+	if cookieCodec == nil {
+		session, err := store.Modify(cookie.Value, fn)
+		if errors.Is(err, ErrSessionNotFound) || errors.Is(err, ErrSessionExpired) {
+			return nil, ErrNoSession
+		}
+		return session, err
+	}
+
+	// Cookie mode: decode, change, send the new cookie back
+	session := getSession(r)
+	if session == nil {
+		return nil, ErrNoSession
+	}
+	if err := fn(session); err != nil {
+		return nil, err
+	}
+	value, err := cookieCodec.Encode(session)
+	if err != nil {
+		return nil, err
+	}
+	setSessionCookie(w, value, session.ExpiresAt)
+	return session, nil
+}
+
+// sessionSet stores v under key in the current session
+func sessionSet(w http.ResponseWriter, r *http.Request, key string, v any) error {
+	_, err := updateSession(w, r, func(s *Session) error { return s.setData(key, v) })
+	return err
+}
+
+// sessionDelete removes key from the current session
+func sessionDelete(w http.ResponseWriter, r *http.Request, key string) error {
+	_, err := updateSession(w, r, func(s *Session) error {
+		delete(s.Data, key)
+		return nil
+	})
+	return err
+}
+
+// ==========================================
+// FLASH MESSAGES
+// ==========================================
+// A flash is stored on one response and shown (then dropped) on the next
+// page, e.g. "Logged in as alice" after the login redirect.
+
+type Flash struct {
+	Kind    string `json:"kind"` // success, info or error (a CSS class)
+	Message string `json:"message"`
+}
+
+// setFlashes queues flashes on a session that isn't saved yet
+func setFlashes(s *Session, flashes []Flash) {
+	queued, _, _ := SessionGet[[]Flash](s, flashKey)
+	s.setData(flashKey, append(queued, flashes...))
+}
+
+// addFlash queues a message for the next page of the current session
+func addFlash(w http.ResponseWriter, r *http.Request, kind, message string) error {
+	_, err := updateSession(w, r, func(s *Session) error {
+		setFlashes(s, []Flash{{kind, message}})
+		return nil
+	})
+	return err
+}
+
+// popFlashes returns the queued messages and removes them
+func popFlashes(w http.ResponseWriter, r *http.Request) []Flash {
+	if session := getSession(r); session == nil || session.Data[flashKey] == "" {
+		return nil // Nothing to do: don't rewrite the store on every page
+	}
+	var flashes []Flash
+	updateSession(w, r, func(s *Session) error {
+		flashes, _, _ = SessionGet[[]Flash](s, flashKey)
+		delete(s.Data, flashKey)
+		return nil
+	})
+	return flashes
+}
+
+// ==========================================
+// /api/session
+// ==========================================
+//   GET    /api/session              who am I, expiry, data, CSRF token
+//   GET    /api/session/data/{key}   one value
+//   PUT    /api/session/data/{key}   store any JSON value
+//   PATCH  /api/session/data         merge an object; null deletes a key
+//   DELETE /api/session/data/{key}   remove -> 204
+//
+// Writes are authenticated by the session cookie, so they need the CSRF
+// token from GET /api/session in an X-CSRF-Token header. API tokens and
+// JWTs have no session of their own, so they are turned away instead of
+// reaching whatever cookie came along with them.
+
+type sessionView struct {
+	Username   string                     `json:"username"`
+	LoginTime  time.Time                  `json:"login_time"`
+	LastAccess time.Time                  `json:"last_access"`
+	ExpiresAt  time.Time                  `json:"expires_at"`
+	Data       map[string]json.RawMessage `json:"data"`
+	CSRFToken  string                     `json:"csrf_token,omitempty"`
+}
+
+func viewSession(s *Session) sessionView {
+	v := sessionView{
+		Username:   s.Username,
+		LoginTime:  s.LoginTime,
+		LastAccess: s.LastAccess,
+		ExpiresAt:  s.ExpiresAt,
+		Data:       make(map[string]json.RawMessage, len(s.Data)),
+	}
+	for key, raw := range s.Data {
+		if !strings.HasPrefix(key, "_") {
+			v.Data[key] = json.RawMessage(raw)
+		}
+	}
+	return v
+}
+
+// cookieSessionOnly rejects requests authenticated by a Bearer token.
+// csrfMiddleware lets those through unchecked, which is only safe when
+// the handler doesn't then act on the cookie session.
+func cookieSessionOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if bearerAuthenticated(r) {
+			writeProblem(w, r, NewProblem(http.StatusForbidden,
+				"The session API works with the session cookie, not API tokens or JWTs."))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Check a key from the path or a PATCH body
+func checkSessionKey(key string) string {
+	switch {
+	case key == "" || len(key) > maxSessionKeyLen:
+		return fmt.Sprintf("must be 1-%d characters", maxSessionKeyLen)
+	case strings.HasPrefix(key, "_"):
+		return "keys starting with '_' are reserved"
+	}
+	return ""
+}
+
+// Answer for errors from updateSession
+func writeSessionError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, ErrNoSession):
+		writeProblem(w, r, NewProblem(http.StatusUnauthorized, "Log in to get a session."))
+	case errors.Is(err, ErrCookieTooLarge):
+		writeProblem(w, r, NewProblem(http.StatusRequestEntityTooLarge, "Session data no longer fits in the session cookie."))
+	default:
+		writeError(w, r, err)
+	}
+}
+
+func apiSessionHandler(w http.ResponseWriter, r *http.Request) {
+	session := getSession(r)
+	if session == nil {
+		writeSessionError(w, r, ErrNoSession)
+		return
+	}
+	view := viewSession(session)
+	view.CSRFToken = csrfToken(w, r)
+	writeJSON(w, http.StatusOK, view)
+}
+
+func apiSessionGetHandler(w http.ResponseWriter, r *http.Request) {
+	session := getSession(r)
+	if session == nil {
+		writeSessionError(w, r, ErrNoSession)
+		return
+	}
+	key := r.PathValue("key")
+	raw, ok := session.Data[key]
+	if !ok || checkSessionKey(key) != "" {
+		writeProblem(w, r, NewProblem(http.StatusNotFound, "no session value "+key))
+		return
+	}
+	writeJSON(w, http.StatusOK, json.RawMessage(raw))
+}
+
+func apiSessionPutHandler(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	if msg := checkSessionKey(key); msg != "" {
+		writeProblem(w, r, validationProblem(FieldErrors{"key": msg}))
+		return
+	}
+	var value json.RawMessage
+	if err := readJSON(w, r, &value); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if err := sessionSet(w, r, key, value); err != nil {
+		writeSessionError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, value)
+}
+
+func apiSessionPatchHandler(w http.ResponseWriter, r *http.Request) {
+	var changes map[string]json.RawMessage
+	if err := readJSON(w, r, &changes); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	errs := FieldErrors{}
+	for key := range changes {
+		if msg := checkSessionKey(key); msg != "" {
+			errs[key] = msg
+		}
+	}
+	if len(errs) > 0 {
+		writeProblem(w, r, validationProblem(errs))
+		return
+	}
+
+	session, err := updateSession(w, r, func(s *Session) error {
+		for key, raw := range changes {
+			if string(raw) == "null" {
+				delete(s.Data, key)
+			} else if err := s.setData(key, raw); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		writeSessionError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, viewSession(session).Data)
+}
+
+func apiSessionDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	if msg := checkSessionKey(key); msg != "" {
+		writeProblem(w, r, validationProblem(FieldErrors{"key": msg}))
+		return
+	}
+	if err := sessionDelete(w, r, key); err != nil {
+		writeSessionError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
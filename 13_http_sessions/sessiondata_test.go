@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessionAPIRejectsBearer(t *testing.T) {
+	saved := store
+	store = NewMemoryStore()
+	t.Cleanup(func() { store = saved })
+
+	now := time.Now()
+	store.Save("alice-session", &Session{Username: "alice", LastAccess: now, ExpiresAt: now.Add(time.Hour)})
+	cookie := &http.Cookie{Name: sessionCookieName, Value: "alice-session"}
+
+	rt := NewRouter()
+	sess := rt.Group("/api/session", cookieSessionOnly, csrfMiddleware)
+	sess.Get("/", apiSessionHandler)
+	sess.Put("/data/{key}", apiSessionPutHandler)
+	sess.Delete("/data/{key}", apiSessionDeleteHandler)
+
+	bearer := func(r *http.Request) *http.Request {
+		return r.WithContext(context.WithValue(r.Context(), apiTokenCtxKey{}, &APIToken{ID: "t1"}))
+	}
+	tests := []struct {
+		name   string
+		method string
+		target string
+		bearer bool
+		csrf   bool
+		want   int
+	}{
+		{"cookie read", "GET", "/api/session", false, false, 200},
+		{"cookie write", "PUT", "/api/session/data/theme", false, true, 200},
+		{"cookie write without CSRF", "PUT", "/api/session/data/theme", false, false, 403},
+		// A token doesn't skip CSRF here: the request is turned away
+		// before the cookie that came with it is touched
+		{"bearer read", "GET", "/api/session", true, false, 403},
+		{"bearer write", "PUT", "/api/session/data/theme", true, false, 403},
+		{"bearer delete", "DELETE", "/api/session/data/theme", true, false, 403},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.target, strings.NewReader(`"dark"`))
+			r.Header.Set("Content-Type", "application/json")
+			r.AddCookie(cookie)
+			if tt.csrf {
+				r.Header.Set(csrfHeader, csrfTokenFor(cookie.Value))
+			}
+			if tt.bearer {
+				r = bearer(r)
+			}
+			w := httptest.NewRecorder()
+			rt.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("got %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+
+	s, _ := store.Get("alice-session")
+	if got := s.Data["theme"]; got != `"dark"` {
+		t.Errorf("theme = %q after the cookie write only", got)
+	}
+}
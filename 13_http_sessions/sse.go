@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ==========================================
+// SERVER-SENT EVENTS: /api/time/stream
+// ==========================================
+// Instead of polling /api/time, a client can open one long response and
+// get a tick pushed every interval:
+//
+//   curl -N localhost:8080/api/time/stream?interval=5
+//
+//   retry: 3000
+//
+//   id: 1760000005
+//   event: tick
+//   data: {"time":"...","timestamp":1760000005,"timezone":"UTC"}
+//
+//   : heartbeat
+//
+// Event IDs are Unix seconds. Browsers resend the last one they saw as
+// Last-Event-ID when they reconnect; the first tick then reports how many
+// were missed. All streams share one ticker (timeTicks), no matter how
+// many clients are connected.
+
+const (
+	sseHeartbeat      = 15 * time.Second // Keeps proxies from closing idle streams
+	sseWriteTimeout   = 10 * time.Second // A client that can't take a write for this long is dropped
+	sseRetry          = 3 * time.Second  // How long browsers wait before reconnecting
+	sseMaxIntervalSec = 3600
+)
+
+// timeTick is the /api/time payload, also sent as each stream event
+type timeTick struct {
+	Time      string `json:"time"`
+	Timestamp int64  `json:"timestamp"`
+	Timezone  string `json:"timezone"`
+	Missed    int64  `json:"missed,omitempty"` // Ticks lost while disconnected
+}
+
+func newTimeTick(now time.Time) timeTick {
+	return timeTick{
+		Time:      now.Format(time.RFC3339),
+		Timestamp: now.Unix(),
+		Timezone:  now.Location().String(),
+	}
+}
+
+// ==========================================
+// BROADCASTER
+// ==========================================
+
+// Broadcaster fans one ticker out to many subscribers. The ticker only
+// runs while someone is subscribed.
+type Broadcaster struct {
+	every time.Duration
+
+	mu     sync.Mutex
+	subs   map[chan time.Time]struct{}
+	stop   chan struct{} // Closes the running ticker goroutine
+	closed bool
+}
+
+func NewBroadcaster(every time.Duration) *Broadcaster {
+	return &Broadcaster{every: every, subs: make(map[chan time.Time]struct{})}
+}
+
+// Subscribe returns a channel of ticks and a function to leave. The
+// channel is closed when the broadcaster shuts down.
+func (b *Broadcaster) Subscribe() (<-chan time.Time, func()) {
+	ch := make(chan time.Time, 1)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	b.subs[ch] = struct{}{}
+	if b.stop == nil {
+		b.stop = make(chan struct{})
+		go b.run(b.stop)
+	}
+	return ch, func() { b.unsubscribe(ch) }
+}
+
+func (b *Broadcaster) unsubscribe(ch chan time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subs[ch]; !ok {
+		return // Already closed by Close
+	}
+	delete(b.subs, ch)
+	close(ch)
+	if len(b.subs) == 0 && b.stop != nil {
+		close(b.stop)
+		b.stop = nil
+	}
+}
+
+func (b *Broadcaster) run(stop chan struct{}) {
+	ticker := time.NewTicker(b.every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			b.mu.Lock()
+			for ch := range b.subs {
+				select {
+				case ch <- now:
+				default: // Subscriber still busy with the last tick: skip this one
+				}
+			}
+			b.mu.Unlock()
+		}
+	}
+}
+
+// Close ends every subscription, so streams finish during shutdown
+// instead of holding it up
+func (b *Broadcaster) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for ch := range b.subs {
+		close(ch)
+	}
+	clear(b.subs)
+	if b.stop != nil {
+		close(b.stop)
+		b.stop = nil
+	}
+}
+
+// Shared by every /api/time/stream client
+var timeTicks = NewBroadcaster(time.Second)
+
+// ==========================================
+// HANDLER
+// ==========================================
+
+// GET /api/time/stream?interval=N (seconds, default 1)
+func apiTimeStreamHandler(w http.ResponseWriter, r *http.Request) {
+	interval := int64(1)
+	if s := r.URL.Query().Get("interval"); s != "" {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n < 1 || n > sseMaxIntervalSec {
+			writeProblem(w, r, validationProblem(FieldErrors{
+				"interval": fmt.Sprintf("must be a number of seconds between 1 and %d", sseMaxIntervalSec),
+			}))
+			return
+		}
+		interval = n
+	}
+
+	// The server's WriteTimeout would cut the stream off; instead each
+	// write gets its own deadline below
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		writeProblem(w, r, NewProblem(http.StatusInternalServerError, "Streaming is not supported on this connection."))
+		return
+	}
+
+	ticks, leave := timeTicks.Subscribe()
+	defer leave()
+
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("X-Accel-Buffering", "no") // Tell nginx not to buffer the stream
+	w.WriteHeader(http.StatusOK)
+
+	send := func(format string, args ...any) bool {
+		rc.SetWriteDeadline(time.Now().Add(sseWriteTimeout))
+		if _, err := fmt.Fprintf(w, format, args...); err != nil {
+			return false
+		}
+		return rc.Flush() == nil
+	}
+	sendTick := func(now time.Time, missed int64) bool {
+		tick := newTimeTick(now)
+		tick.Missed = missed
+		data, _ := json.Marshal(tick)
+		return send("id: %d\nevent: tick\ndata: %s\n\n", tick.Timestamp, data)
+	}
+
+	// First event right away: a catch-up after a reconnect, or a snapshot
+	now := time.Now()
+	var missed int64
+	if last, err := strconv.ParseInt(r.Header.Get("Last-Event-ID"), 10, 64); err == nil && last < now.Unix() {
+		missed = max(0, (now.Unix()-last)/interval-1)
+	}
+	if !send("retry: %d\n\n", sseRetry.Milliseconds()) || !sendTick(now, missed) {
+		return
+	}
+	lastSent := now.Unix()
+
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done(): // Client went away
+			return
+		case now, ok := <-ticks:
+			if !ok {
+				return // Server shutting down
+			}
+			if now.Unix()-lastSent < interval {
+				continue
+			}
+			if !sendTick(now, 0) {
+				return
+			}
+			lastSent = now.Unix()
+		case <-heartbeat.C:
+			if !send(": heartbeat\n\n") {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,48 @@
+// Chat client for /chat/ws (see chat.go). Text is always inserted with
+// textContent, never innerHTML, so messages can't inject markup.
+(function () {
+    var log = document.getElementById("log");
+    var status = document.getElementById("status");
+    var online = document.getElementById("online");
+    var form = document.getElementById("send");
+    var input = document.getElementById("text");
+    var ws;
+
+    function show(line, muted) {
+        var p = document.createElement("div");
+        p.textContent = line;
+        if (muted) p.style.color = "#777";
+        log.appendChild(p);
+        log.scrollTop = log.scrollHeight;
+    }
+
+    function connect() {
+        var scheme = location.protocol === "https:" ? "wss://" : "ws://";
+        ws = new WebSocket(scheme + location.host + "/chat/ws");
+        ws.onopen = function () { status.textContent = "Connected."; };
+        ws.onmessage = function (e) {
+            var ev = JSON.parse(e.data);
+            var time = new Date(ev.time).toLocaleTimeString();
+            if (ev.type === "message") {
+                show("[" + time + "] " + ev.user + ": " + ev.text);
+            } else {
+                show("[" + time + "] " + ev.user + (ev.type === "join" ? " joined" : " left"), true);
+                online.textContent = "Online: " + (ev.online || []).join(", ");
+            }
+        };
+        ws.onclose = function (e) {
+            status.textContent = "Disconnected" + (e.reason ? " (" + e.reason + ")" : "") + ", reconnecting...";
+            setTimeout(connect, 3000);
+        };
+    }
+
+    form.addEventListener("submit", function (e) {
+        e.preventDefault();
+        if (ws && ws.readyState === WebSocket.OPEN && input.value.trim() !== "") {
+            ws.send(input.value);
+            input.value = "";
+        }
+    });
+
+    connect();
+})();
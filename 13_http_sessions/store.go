@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ==========================================
+// SESSION STORE INTERFACE
+// ==========================================
+
+// ErrSessionNotFound is returned when a session ID is unknown to the store
+var ErrSessionNotFound = errors.New("session not found")
+
+// ErrSessionExpired is returned by Get for a session past one of its timeouts
+var ErrSessionExpired = errors.New("session expired")
+
+// SessionStore is anything that can keep sessions by ID.
+// Handlers only talk to this interface, so the backend can be swapped
+// (memory, file, ...) without touching them.
+type SessionStore interface {
+	Get(id string) (*Session, error)
+	Save(id string, session *Session) error
+	Delete(ids ...string) error // Several at once cost a single write
+	Touch(id string) error      // Mark the session as used right now
+	List() (map[string]*Session, error)
+
+	// Rotate drops oldID and stores session under newID in one step,
+	// so there is no moment where both IDs (or neither) are valid
+	Rotate(oldID, newID string, session *Session) error
+
+	// Modify runs fn on the session under the store's lock and saves the
+	// result, so two requests changing Data at once don't lose writes.
+	// If fn returns an error nothing is saved.
+	Modify(id string, fn func(*Session) error) (*Session, error)
+}
+
+// Pick a store by name ("memory" or "file")
+func newSessionStore(kind, path string) (SessionStore, error) {
+	switch kind {
+	case "memory", "":
+		return NewMemoryStore(), nil
+	case "file":
+		return NewFileStore(path)
+	default:
+		return nil, errors.New("unknown session store: " + kind)
+	}
+}
+
+// ==========================================
+// IN-MEMORY STORE (default)
+// ==========================================
+
+// MemoryStore keeps sessions in a map guarded by a RWMutex
+type MemoryStore struct {
+	mu       sync.RWMutex // For thread-safe access
+	sessions map[string]*Session
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{sessions: make(map[string]*Session)}
+}
+
+// Get returns a copy: change sessions through Modify
+func (m *MemoryStore) Get(id string) (*Session, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	session, ok := m.sessions[id]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	if session.Expired(time.Now()) {
+		return nil, ErrSessionExpired
+	}
+	return session.clone(), nil
+}
+
+func (m *MemoryStore) Save(id string, session *Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sessions[id] = session
+	return nil
+}
+
+func (m *MemoryStore) Delete(ids ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, id := range ids {
+		delete(m.sessions, id)
+	}
+	return nil
+}
+
+func (m *MemoryStore) Rotate(oldID, newID string, session *Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, oldID)
+	m.sessions[newID] = session
+	return nil
+}
+
+func (m *MemoryStore) Modify(id string, fn func(*Session) error) (*Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	session, ok := m.sessions[id]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	if session.Expired(time.Now()) {
+		return nil, ErrSessionExpired
+	}
+	changed := session.clone() // fn failing halfway leaves the original alone
+	if err := fn(changed); err != nil {
+		return nil, err
+	}
+	m.sessions[id] = changed
+	return changed.clone(), nil
+}
+
+func (m *MemoryStore) Touch(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	session, ok := m.sessions[id]
+	if !ok {
+		return ErrSessionNotFound
+	}
+	session.LastAccess = time.Now()
+	return nil
+}
+
+// List returns copies of the sessions so callers can read them
+// without racing against Touch
+func (m *MemoryStore) List() (map[string]*Session, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	out := make(map[string]*Session, len(m.sessions))
+	for id, session := range m.sessions {
+		out[id] = session.clone()
+	}
+	return out, nil
+}
+
+// ==========================================
+// FILE-BACKED STORE
+// ==========================================
+
+// FileStore is a MemoryStore that writes every change to a JSON file,
+// so sessions survive a server restart. Touch happens on every request,
+// so it only marks the store dirty; the next write (or Close) saves it.
+type FileStore struct {
+	*MemoryStore
+	path   string
+	fileMu sync.Mutex // Serializes writes to the file
+	dirty  atomic.Bool
+}
+
+// NewFileStore loads existing sessions from path (if the file exists)
+func NewFileStore(path string) (*FileStore, error) {
+	fs := &FileStore{MemoryStore: NewMemoryStore(), path: path}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return fs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &fs.sessions); err != nil {
+			return nil, err
+		}
+	}
+	return fs, nil
+}
+
+func (f *FileStore) Save(id string, session *Session) error {
+	f.MemoryStore.Save(id, session)
+	return f.persist()
+}
+
+func (f *FileStore) Delete(ids ...string) error {
+	f.MemoryStore.Delete(ids...)
+	return f.persist()
+}
+
+func (f *FileStore) Rotate(oldID, newID string, session *Session) error {
+	f.MemoryStore.Rotate(oldID, newID, session)
+	return f.persist()
+}
+
+func (f *FileStore) Modify(id string, fn func(*Session) error) (*Session, error) {
+	session, err := f.MemoryStore.Modify(id, fn)
+	if err != nil {
+		return nil, err
+	}
+	return session, f.persist()
+}
+
+func (f *FileStore) Touch(id string) error {
+	if err := f.MemoryStore.Touch(id); err != nil {
+		return err
+	}
+	f.dirty.Store(true)
+	return nil
+}
+
+// Close writes any pending changes, call it on shutdown
+func (f *FileStore) Close() error {
+	if !f.dirty.Load() {
+		return nil
+	}
+	return f.persist()
+}
+
+// Write all sessions to a temp file, then rename it over the real one.
+// The rename is atomic, so a crash never leaves a half-written file.
+func (f *FileStore) persist() error {
+	f.fileMu.Lock()
+	defer f.fileMu.Unlock()
+	f.dirty.Store(false)
+
+	f.mu.RLock()
+	data, err := json.MarshalIndent(f.sessions, "", "  ")
+	f.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), ".sessions-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // No-op once renamed
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
+
+// ==========================================
+// EXPIRY JANITOR
+// ==========================================
+
+// Remove every expired session from the store, returns how many went
+func reapExpired(store SessionStore) (int, error) {
+	all, err := store.List()
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	var expired []string
+	for id, session := range all {
+		if session.Expired(now) {
+			expired = append(expired, id)
+		}
+	}
+	if len(expired) == 0 {
+		return 0, nil
+	}
+	// One call, so FileStore rewrites its file once and not per session
+	if err := store.Delete(expired...); err != nil {
+		return 0, err
+	}
+	return len(expired), nil
+}
+
+// Run reapExpired every interval until ctx is cancelled. An interval of
+// 0 (or less) turns the reaper off: expired sessions are still refused
+// by Get, they just stay in the store.
+func startReaper(ctx context.Context, store SessionStore, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				n, err := reapExpired(store)
+				if err != nil {
+					log.Printf("session reaper: %v", err)
+				}
+				if n > 0 {
+					log.Printf("session reaper: removed %d expired session(s)", n)
+				}
+			}
+		}
+	}()
+}
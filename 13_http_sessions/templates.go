@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ==========================================
+// HTML TEMPLATES
+// ==========================================
+// templates/
+//   base.html        page skeleton, defines "base"
+//   partials/*.html  reusable pieces ("login_form", "api_links", ...)
+//   pages/*.html     one per page, each defines "content" (and maybe "title")
+//
+// html/template escapes everything it prints, so a username like
+// <script>...</script> shows up as text instead of running.
+
+//go:embed templates
+var embeddedTemplates embed.FS
+
+// Scripts for the pages, served at /static/{file}
+//
+//go:embed static
+var embeddedStatic embed.FS
+
+func staticHandler(w http.ResponseWriter, r *http.Request) {
+	http.ServeFileFS(w, r, embeddedStatic, path.Join("static", r.PathValue("file")))
+}
+
+// Renderer parses base + partials + one page into a template per page.
+// In dev mode it re-reads the files from disk on every request, so
+// template edits show up without restarting the server.
+type Renderer struct {
+	mu    sync.RWMutex
+	files fs.FS
+	dev   bool
+	pages map[string]*template.Template
+}
+
+// NewRenderer uses the embedded templates, or the dir on disk when dev is on
+func NewRenderer(dev bool, dir string) (*Renderer, error) {
+	files, err := fs.Sub(embeddedTemplates, "templates")
+	if err != nil {
+		return nil, err
+	}
+	if dev {
+		files = os.DirFS(dir)
+	}
+
+	r := &Renderer{files: files, dev: dev}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Parse every page together with the shared base and partials
+func (r *Renderer) load() error {
+	base, err := template.ParseFS(r.files, "base.html", "partials/*.html")
+	if err != nil {
+		return err
+	}
+
+	pageFiles, err := fs.Glob(r.files, "pages/*.html")
+	if err != nil {
+		return err
+	}
+
+	pages := make(map[string]*template.Template, len(pageFiles))
+	for _, file := range pageFiles {
+		clone, err := base.Clone()
+		if err != nil {
+			return err
+		}
+		page, err := clone.ParseFS(r.files, file)
+		if err != nil {
+			return err
+		}
+		pages[strings.TrimSuffix(path.Base(file), ".html")] = page
+	}
+
+	r.mu.Lock()
+	r.pages = pages
+	r.mu.Unlock()
+	return nil
+}
+
+// Render executes a page into a buffer first, so a template error
+// becomes a clean 500 instead of half a page
+func (r *Renderer) Render(w http.ResponseWriter, name string, data any) {
+	r.RenderStatus(w, http.StatusOK, name, data)
+}
+
+// RenderStatus is Render with a status code other than 200.
+// Errors here are answered in plain text: the error page itself may be
+// what failed.
+func (r *Renderer) RenderStatus(w http.ResponseWriter, status int, name string, data any) {
+	if r.dev {
+		if err := r.load(); err != nil {
+			log.Printf("reloading templates: %v", err)
+			http.Error(w, "Template error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	r.mu.RLock()
+	page, ok := r.pages[name]
+	r.mu.RUnlock()
+	if !ok {
+		log.Printf("render: no page %q", name)
+		http.Error(w, "Page not found", http.StatusInternalServerError)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := page.ExecuteTemplate(&buf, "base", data); err != nil {
+		log.Printf("render %s: %v", name, err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(status)
+	buf.WriteTo(w)
+}
@@ -0,0 +1,518 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ==========================================
+// PERSONAL ACCESS TOKENS
+// ==========================================
+// Scripts can't fill in the login form, so logged-in users can create
+// tokens on the dashboard and send them to /api/*:
+//
+//   curl -H "Authorization: Bearer pat_..." localhost:8080/api/users
+//
+// A token acts as its user, limited to the scopes picked when it was made
+// (scopes are permissions, see auth.go). It never outlives its expiry,
+// and losing a permission takes it away from the user's tokens too.
+//
+// Only a SHA-256 of each token is stored. That is enough because tokens
+// are 32 random bytes: there is nothing to guess, unlike passwords (which
+// need the slow scrypt in password.go). The token itself is shown once,
+// right after it is created.
+
+const (
+	apiTokenPrefix   = "pat_" // Makes leaked tokens easy to spot (and grep for)
+	maxTokensPerUser = 20
+	maxTokenNameLen  = 64
+	tokenTouchEvery  = time.Minute // last_used_at is saved at most this often
+)
+
+// Lifetimes offered on the dashboard, in days
+var tokenLifetimes = []int{7, 30, 90, 365}
+
+var (
+	ErrTokenNotFound = errors.New("token not found")
+	ErrTokenInvalid  = errors.New("invalid, expired or revoked token")
+	ErrTooManyTokens = fmt.Errorf("at most %d tokens per user", maxTokensPerUser)
+)
+
+type APIToken struct {
+	ID            string    `json:"id"` // Public, used to revoke
+	UserID        int       `json:"user_id"`
+	UserCreatedAt time.Time `json:"user_created_at"` // Tells the owner from any later account with the same ID
+	Name          string    `json:"name"`
+	Hash          string    `json:"hash"` // Hex SHA-256 of the token
+	Hint          string    `json:"hint"` // First characters, to tell tokens apart
+	Scopes        []string  `json:"scopes"`
+	CreatedAt     time.Time `json:"created_at"`
+	ExpiresAt     time.Time `json:"expires_at"`
+	LastUsedAt    time.Time `json:"last_used_at,omitzero"`
+}
+
+func (t *APIToken) Expired(now time.Time) bool { return !now.Before(t.ExpiresAt) }
+
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// ==========================================
+// TOKEN STORE
+// ==========================================
+
+// FileTokenStore keeps tokens in memory and in a JSON file, like
+// FileUserStore. An empty path keeps them in memory only.
+type FileTokenStore struct {
+	mu     sync.Mutex
+	path   string
+	tokens map[string]*APIToken // By ID
+	byHash map[string]string    // Hash -> ID
+}
+
+func NewFileTokenStore(path string) (*FileTokenStore, error) {
+	s := &FileTokenStore{
+		path:   path,
+		tokens: make(map[string]*APIToken),
+		byHash: make(map[string]string),
+	}
+	if path == "" {
+		return s, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var list []*APIToken
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &list); err != nil {
+			return nil, err
+		}
+	}
+	for _, t := range list {
+		s.tokens[t.ID] = t
+		s.byHash[t.Hash] = t.ID
+	}
+	return s, nil
+}
+
+// Create makes a new token for user and returns it with its secret, the
+// only time the secret is available. The user's expired tokens are
+// cleared out first.
+func (s *FileTokenStore) Create(user *User, name string, scopes []string, ttl time.Duration) (string, *APIToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	count := 0
+	for id, t := range s.tokens {
+		if t.UserID != user.ID {
+			continue
+		}
+		if t.Expired(now) {
+			delete(s.byHash, t.Hash)
+			delete(s.tokens, id)
+			continue
+		}
+		count++
+	}
+	if count >= maxTokensPerUser {
+		return "", nil, ErrTooManyTokens
+	}
+
+	secret := apiTokenPrefix + generateSessionID() // 32 random bytes
+	id := make([]byte, 8)
+	rand.Read(id)
+	token := &APIToken{
+		ID:            hex.EncodeToString(id),
+		UserID:        user.ID,
+		UserCreatedAt: user.CreatedAt,
+		Name:          name,
+		Hash:          hashToken(secret),
+		Hint:          secret[:len(apiTokenPrefix)+4],
+		Scopes:        slices.Clone(scopes),
+		CreatedAt:     now,
+		ExpiresAt:     now.Add(ttl),
+	}
+	s.tokens[token.ID] = token
+	s.byHash[token.Hash] = token.ID
+	if err := s.persist(); err != nil {
+		delete(s.tokens, token.ID)
+		delete(s.byHash, token.Hash)
+		return "", nil, err
+	}
+	copied := *token
+	return secret, &copied, nil
+}
+
+// Lookup finds the token for secret and records that it was used
+func (s *FileTokenStore) Lookup(secret string, now time.Time) (*APIToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id, ok := s.byHash[hashToken(secret)]
+	if !ok {
+		return nil, ErrTokenInvalid
+	}
+	token := s.tokens[id]
+	if token.Expired(now) {
+		return nil, ErrTokenInvalid
+	}
+	// Writing the file on every API call would be wasteful. A failed save
+	// doesn't fail the request: only the last-used time is lost.
+	touch := now.Sub(token.LastUsedAt) >= tokenTouchEvery
+	token.LastUsedAt = now
+	if touch {
+		if err := s.persist(); err != nil {
+			log.Printf("tokens: saving last use of %s: %v", token.ID, err)
+		}
+	}
+	copied := *token
+	return &copied, nil
+}
+
+// ListByUser returns userID's tokens, newest first
+func (s *FileTokenStore) ListByUser(userID int) []*APIToken {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := []*APIToken{}
+	for _, t := range s.tokens {
+		if t.UserID == userID {
+			copied := *t
+			list = append(list, &copied)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+	return list
+}
+
+// Revoke deletes one of userID's tokens. Someone else's token is "not
+// found", so IDs can't be probed.
+func (s *FileTokenStore) Revoke(userID int, id string) (*APIToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token, ok := s.tokens[id]
+	if !ok || token.UserID != userID {
+		return nil, ErrTokenNotFound
+	}
+	delete(s.tokens, id)
+	delete(s.byHash, token.Hash)
+	if err := s.persist(); err != nil {
+		s.tokens[id] = token
+		s.byHash[token.Hash] = id
+		return nil, err
+	}
+	return token, nil
+}
+
+// RevokeUser deletes all of userID's tokens, for when the account is
+// deleted. Returns how many there were.
+func (s *FileTokenStore) RevokeUser(userID int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	removed := 0
+	for id, t := range s.tokens {
+		if t.UserID == userID {
+			delete(s.tokens, id)
+			delete(s.byHash, t.Hash)
+			removed++
+		}
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+	return removed, s.persist()
+}
+
+// Write to a temp file and rename (same approach as FileStore).
+// Caller holds the lock.
+func (s *FileTokenStore) persist() error {
+	if s.path == "" {
+		return nil
+	}
+	list := make([]*APIToken, 0, len(s.tokens))
+	for _, t := range s.tokens {
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".tokens-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// ==========================================
+// BEARER AUTH MIDDLEWARE
+// ==========================================
+// bearerAuth turns a valid "Authorization: Bearer" token into a Session
+// for currentSession, so RequireAuth and RequirePermission work the same
+// for tokens and cookies. The token is either one of ours (pat_...) or a
+// JWT access token (see jwtauth.go). Requests without the header pass
+// through untouched.
+//
+// A bad token is a 401, even if a session cookie came along, but not
+// right away: bearerAuth only notes it, the API rate limit runs (keyed by
+// IP for such requests, see rateKeyClient), and rejectBadBearer answers.
+// That way guessing tokens is throttled like everything else.
+
+type (
+	apiTokenCtxKey  struct{}
+	jwtClaimsCtxKey struct{}
+	bearerErrCtxKey struct{}
+)
+
+// bearerFailure is why bearerAuth refused a token
+type bearerFailure struct {
+	challenge string // WWW-Authenticate value
+	problem   *Problem
+}
+
+// requestToken returns the API token that authenticated r, or nil
+func requestToken(r *http.Request) *APIToken {
+	token, _ := r.Context().Value(apiTokenCtxKey{}).(*APIToken)
+	return token
+}
+
+// bearerAuthenticated reports whether r was authenticated by a Bearer
+// token (API token or JWT) rather than a cookie
+func bearerAuthenticated(r *http.Request) bool {
+	return requestToken(r) != nil || r.Context().Value(jwtClaimsCtxKey{}) != nil
+}
+
+func bearerAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scheme, secret, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+		if !strings.EqualFold(scheme, "Bearer") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		secret = strings.TrimSpace(secret)
+		now := time.Now()
+		ctx := r.Context()
+
+		var session *Session
+		if strings.HasPrefix(secret, apiTokenPrefix) {
+			s, token, err := sessionForToken(secret, now)
+			if err != nil {
+				next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, bearerErrCtxKey{}, &bearerFailure{
+					challenge: `Bearer error="invalid_token"`,
+					problem:   NewProblem(http.StatusUnauthorized, "The API token is invalid, expired or revoked."),
+				})))
+				return
+			}
+			session = s
+			ctx = context.WithValue(ctx, apiTokenCtxKey{}, token)
+		} else {
+			s, claims, err := jwtIssuer.sessionFor(secret, now)
+			if err != nil {
+				next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, bearerErrCtxKey{}, &bearerFailure{
+					challenge: `Bearer error="invalid_token", error_description="` + jwtErrorDescription(err) + `"`,
+					problem:   NewProblem(http.StatusUnauthorized, "Access token rejected: "+err.Error()+"."),
+				})))
+				return
+			}
+			session = s
+			ctx = context.WithValue(ctx, jwtClaimsCtxKey{}, claims)
+		}
+		noteUser(r, session.Username)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, sessionCtxKey{}, session)))
+	})
+}
+
+// jwtErrorDescription is the error_description for a rejected JWT. The
+// reason tells the SPA whether refreshing will help. The strings are
+// fixed (never err.Error()) so nothing can break the header's quoting.
+func jwtErrorDescription(err error) string {
+	switch {
+	case errors.Is(err, ErrJWTExpired):
+		return "The access token expired"
+	case errors.Is(err, ErrJWTNotYetValid):
+		return "The access token is not valid yet"
+	case errors.Is(err, ErrJWTUnknownKey):
+		return "The access token was signed with an unknown key"
+	default:
+		return "The access token is invalid"
+	}
+}
+
+// rejectBadBearer answers 401 for a token bearerAuth refused
+func rejectBadBearer(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if f, ok := r.Context().Value(bearerErrCtxKey{}).(*bearerFailure); ok {
+			w.Header().Set("WWW-Authenticate", f.challenge)
+			writeProblem(w, r, f.problem)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// sessionForToken builds the identity a token stands for: its user, with
+// the user's current permissions narrowed down to the token's scopes
+func sessionForToken(secret string, now time.Time) (*Session, *APIToken, error) {
+	token, err := tokenStore.Lookup(secret, now)
+	if err != nil {
+		return nil, nil, err
+	}
+	user, err := userStore.GetByID(token.UserID)
+	if err != nil || !user.CreatedAt.Equal(token.UserCreatedAt) {
+		return nil, nil, ErrTokenInvalid // Account was deleted (or isn't the owner's)
+	}
+	perms := slices.DeleteFunc(effectivePermissions(user.Roles, user.Permissions), func(p string) bool {
+		return !slices.Contains(token.Scopes, p)
+	})
+	return &Session{
+		Username:    user.Username,
+		LoginTime:   token.CreatedAt,
+		LastAccess:  now,
+		ExpiresAt:   token.ExpiresAt,
+		Permissions: perms, // No Roles: a token only has its scopes
+	}, token, nil
+}
+
+// ==========================================
+// DASHBOARD: CREATE, LIST, REVOKE
+// ==========================================
+//   POST /tokens               name, scope (repeated), expires_days
+//   POST /tokens/{id}/revoke
+
+// tokensPage is the token section of the dashboard
+type tokensPage struct {
+	List      []*APIToken
+	New       string   // Secret of the token just created, shown once
+	Scopes    []string // What the user may grant
+	Lifetimes []int
+	Now       time.Time
+}
+
+// renderDashboard shows the dashboard, with newToken if one was just made
+func renderDashboard(w http.ResponseWriter, r *http.Request, status int, newToken string) {
+	session := currentSession(r)
+	page := &tokensPage{New: newToken, Scopes: session.Permissions, Lifetimes: tokenLifetimes, Now: time.Now()}
+	if user, err := userStore.GetByUsername(session.Username); err == nil {
+		page.List = tokenStore.ListByUser(user.ID)
+	}
+	renderer.RenderStatus(w, status, "dashboard", pageData{
+		Session:   session,
+		CSRFToken: csrfToken(w, r),
+		Flashes:   popFlashes(w, r),
+		Tokens:    page,
+	})
+}
+
+func createTokenHandler(w http.ResponseWriter, r *http.Request) {
+	session := currentSession(r)
+	user, err := userStore.GetByUsername(session.Username)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	name := strings.TrimSpace(r.PostFormValue("name"))
+	scopes := r.PostForm["scope"]
+	days, _ := strconv.Atoi(r.PostFormValue("expires_days"))
+	errs := FieldErrors{}
+	if name == "" || len(name) > maxTokenNameLen {
+		errs["name"] = fmt.Sprintf("must be 1-%d characters", maxTokenNameLen)
+	}
+	if len(scopes) == 0 {
+		errs["scope"] = "pick at least one"
+	}
+	for _, scope := range scopes {
+		if !session.Can(scope) {
+			errs["scope"] = "you don't have the " + scope + " permission"
+		}
+	}
+	if !slices.Contains(tokenLifetimes, days) {
+		errs["expires_days"] = fmt.Sprintf("must be one of %v", tokenLifetimes)
+	}
+	if len(errs) > 0 {
+		writeProblem(w, r, validationProblem(errs))
+		return
+	}
+
+	slices.Sort(scopes)
+	secret, token, err := tokenStore.Create(user, name, slices.Compact(scopes), time.Duration(days)*24*time.Hour)
+	if errors.Is(err, ErrTooManyTokens) {
+		writeProblem(w, r, &Problem{Type: problemConflict, Title: "Too many tokens",
+			Status: http.StatusConflict, Detail: "You already have " + err.Error() + ". Revoke one first."})
+		return
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	auditLog.LogAttrs(r.Context(), slog.LevelInfo, "token created",
+		slog.String("user", user.Username),
+		slog.String("token", token.ID),
+		slog.Any("scopes", token.Scopes),
+		slog.Time("expires", token.ExpiresAt),
+		slog.String("request_id", requestID(r)),
+	)
+
+	// Rendered right here instead of redirecting: the secret must not be
+	// stored anywhere, not even in the session for a flash
+	w.Header().Set("Cache-Control", "no-store")
+	renderDashboard(w, r, http.StatusCreated, secret)
+}
+
+func revokeTokenHandler(w http.ResponseWriter, r *http.Request) {
+	session := currentSession(r)
+	user, err := userStore.GetByUsername(session.Username)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	token, err := tokenStore.Revoke(user.ID, r.PathValue("id"))
+	if errors.Is(err, ErrTokenNotFound) {
+		writeProblem(w, r, NewProblem(http.StatusNotFound, "no such token"))
+		return
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	auditLog.LogAttrs(r.Context(), slog.LevelInfo, "token revoked",
+		slog.String("user", user.Username),
+		slog.String("token", token.ID),
+		slog.String("request_id", requestID(r)),
+	)
+	addFlash(w, r, "success", "Revoked token '"+token.Name+"'")
+	http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Saving the last-used time is best effort: a failed save is logged and
+// the token still works
+func TestTokenLookupLogsSaveError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	tokens, err := NewFileTokenStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, created, err := tokens.Create(&User{ID: 1, Username: "alice"}, "ci", nil, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	// A directory in the file's place: the rename that saves it fails
+	os.Remove(path)
+	os.Mkdir(path, 0o755)
+	os.WriteFile(filepath.Join(path, "keep"), nil, 0o644)
+
+	later := time.Now().Add(2 * tokenTouchEvery)
+	token, err := tokens.Lookup(secret, later)
+	if err != nil || token.ID != created.ID {
+		t.Fatalf("lookup: %+v, %v", token, err)
+	}
+	if !token.LastUsedAt.Equal(later) {
+		t.Errorf("last used %v", token.LastUsedAt)
+	}
+	if !strings.Contains(logged.String(), "tokens: saving last use of "+created.ID) {
+		t.Errorf("nothing logged: %q", logged.String())
+	}
+
+	// Within tokenTouchEvery nothing is saved, so nothing fails
+	logged.Reset()
+	tokens.Lookup(secret, later.Add(time.Second))
+	if logged.Len() != 0 {
+		t.Errorf("saved again: %q", logged.String())
+	}
+}
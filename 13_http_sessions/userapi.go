@@ -0,0 +1,353 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ==========================================
+// /api/users REST RESOURCE
+// ==========================================
+//   GET    /api/users        list (?limit, ?cursor, ?sort, ?filter[field], ?q)
+//   POST   /api/users        create  -> 201 + Location
+//   GET    /api/users/{id}   fetch
+//   PUT    /api/users/{id}   replace (username; name, email, password, roles optional)
+//   PATCH  /api/users/{id}   change only the fields sent
+//   DELETE /api/users/{id}   remove  -> 204
+//
+// Usernames can't be changed: sessions, lockouts and rate limits are all
+// keyed by them, so a rename would leave those behind under the old name.
+
+// userInput is the JSON body for POST/PUT/PATCH. Pointers tell
+// "field not sent" apart from "field sent empty", which PATCH needs.
+type userInput struct {
+	Username *string `json:"username"`
+	Name     *string `json:"name"`
+	Email    *string `json:"email"`
+	Password *string `json:"password"`
+
+	Roles       *[]string `json:"roles"`       // Default on create: member
+	Permissions *[]string `json:"permissions"` // Extra grants, see auth.go
+
+	// Read-only: accepted (and ignored) so a GET response can be sent
+	// back as a PUT. A PUT's id must match the URL.
+	ID        *int       `json:"id"`
+	CreatedAt *time.Time `json:"created_at"`
+	UpdatedAt *time.Time `json:"updated_at"`
+}
+
+var errUsernameChanged = errors.New("username cannot be changed")
+
+// Which fields must be present
+type inputMode int
+
+const (
+	modeCreate  inputMode = iota // username, password required
+	modeReplace                  // username required
+	modePatch                    // nothing required
+)
+
+// validate trims the input and checks every field that was sent
+func (in *userInput) validate(mode inputMode) FieldErrors {
+	errs := FieldErrors{}
+	for _, p := range []*string{in.Username, in.Name, in.Email} {
+		if p != nil {
+			*p = strings.TrimSpace(*p)
+		}
+	}
+
+	required := func(field string, p *string) bool {
+		if p == nil || *p == "" {
+			if mode != modePatch {
+				errs[field] = "is required"
+			} else if p != nil {
+				errs[field] = "cannot be empty"
+			}
+			return false
+		}
+		return true
+	}
+
+	if required("username", in.Username) {
+		if msg := checkUsername(*in.Username); msg != "" {
+			errs["username"] = msg
+		}
+	}
+	// Optional, like on the registration form; "" clears it
+	if in.Email != nil && *in.Email != "" {
+		if msg := checkEmail(*in.Email); msg != "" {
+			errs["email"] = msg
+		}
+	}
+	if in.Roles != nil {
+		for _, role := range *in.Roles {
+			if _, ok := rolePermissions[role]; !ok {
+				errs["roles"] = fmt.Sprintf("unknown role %q", role)
+			}
+		}
+	}
+	if in.Permissions != nil {
+		for _, perm := range *in.Permissions {
+			if !knownPermission(perm) {
+				errs["permissions"] = fmt.Sprintf("unknown permission %q", perm)
+			}
+		}
+	}
+	if in.Name != nil && len(*in.Name) > 100 {
+		errs["name"] = "must be at most 100 characters"
+	}
+	if in.Password != nil || mode == modeCreate {
+		if in.Password == nil {
+			errs["password"] = "is required"
+		} else if msg := checkPassword(*in.Password); msg != "" {
+			errs["password"] = msg
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// Hash the password if one was sent. Done before touching the store:
+// scrypt is slow on purpose and shouldn't run under the store lock.
+func (in *userInput) passwordHash() (string, error) {
+	if in.Password == nil {
+		return "", nil
+	}
+	return hashPassword(*in.Password)
+}
+
+// apply copies the sent fields onto u
+func (in *userInput) apply(u *User, mode inputMode, passwordHash string) {
+	if in.Username != nil {
+		u.Username = *in.Username
+	}
+	if in.Email != nil || mode == modeReplace {
+		u.Email = "" // PUT without an email clears it
+		if in.Email != nil {
+			u.Email = *in.Email
+		}
+	}
+	if in.Name != nil || mode == modeReplace {
+		u.Name = "" // Same for the name
+		if in.Name != nil {
+			u.Name = *in.Name
+		}
+	}
+	if in.Roles != nil {
+		u.Roles = slices.Clone(*in.Roles)
+	} else if mode == modeCreate {
+		u.Roles = rolesFor(u.Username)
+	}
+	if in.Permissions != nil {
+		u.Permissions = slices.Clone(*in.Permissions)
+	}
+	if passwordHash != "" {
+		u.PasswordHash = passwordHash
+	}
+	u.UpdatedAt = time.Now()
+}
+
+// Parse {id} from the path, answering 400 itself when it's not a number
+func userIDParam(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil || id <= 0 {
+		writeProblem(w, r, NewProblem(http.StatusBadRequest, "user id must be a positive number"))
+		return 0, false
+	}
+	return id, true
+}
+
+// Map store errors to problems; anything unexpected becomes a 500
+func writeUserStoreError(w http.ResponseWriter, r *http.Request, err error) {
+	conflict := func(field, msg string) *Problem {
+		return &Problem{
+			Type: problemConflict, Title: "Already exists", Status: http.StatusConflict,
+			Detail: err.Error(), Errors: FieldErrors{field: msg},
+		}
+	}
+	switch {
+	case errors.Is(err, ErrUserNotFound):
+		writeProblem(w, r, NewProblem(http.StatusNotFound, "user not found"))
+	case errors.Is(err, ErrUserExists):
+		writeProblem(w, r, conflict("username", "is already taken"))
+	case errors.Is(err, ErrEmailTaken):
+		writeProblem(w, r, conflict("email", "is already in use"))
+	default:
+		writeError(w, r, err)
+	}
+}
+
+// How /api/users can be sorted, filtered and searched (see listing.go)
+var userListSpec = &ListSpec[*User]{
+	Fields: map[string]func(*User) any{
+		"id":         func(u *User) any { return u.ID },
+		"username":   func(u *User) any { return u.Username },
+		"name":       func(u *User) any { return u.Name },
+		"email":      func(u *User) any { return u.Email },
+		"created_at": func(u *User) any { return u.CreatedAt },
+	},
+	IDField:     "id",
+	DefaultSort: "id",
+	Search: func(u *User, q string) bool {
+		q = strings.ToLower(q)
+		return strings.Contains(strings.ToLower(u.Username), q) ||
+			strings.Contains(strings.ToLower(u.Name), q) ||
+			strings.Contains(strings.ToLower(u.Email), q)
+	},
+	DefaultLimit: 20,
+	MaxLimit:     100,
+}
+
+// API: List users (paginated, see userListSpec)
+var apiUsersHandler = listHandler(userListSpec,
+	func(r *http.Request) ([]*User, error) { return userStore.List() },
+	(*User).Public,
+)
+
+// API: Get one user
+func apiUserHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := userIDParam(w, r)
+	if !ok {
+		return
+	}
+	user, err := userStore.GetByID(id)
+	if err != nil {
+		writeUserStoreError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, user.Public())
+}
+
+// API: Create user
+func apiCreateUserHandler(w http.ResponseWriter, r *http.Request) {
+	var in userInput
+	if err := readJSON(w, r, &in); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if errs := in.validate(modeCreate); errs != nil {
+		writeProblem(w, r, validationProblem(errs))
+		return
+	}
+
+	hash, err := in.passwordHash()
+	if err != nil {
+		writeUserStoreError(w, r, err)
+		return
+	}
+	user := &User{CreatedAt: time.Now()}
+	in.apply(user, modeCreate, hash)
+	if err := userStore.Create(user); err != nil {
+		writeUserStoreError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Location", "/api/users/"+strconv.Itoa(user.ID))
+	writeJSON(w, http.StatusCreated, user.Public())
+}
+
+// API: Replace user (PUT) or change some fields (PATCH)
+func apiReplaceUserHandler(w http.ResponseWriter, r *http.Request) {
+	updateUser(w, r, modeReplace)
+}
+
+func apiPatchUserHandler(w http.ResponseWriter, r *http.Request) {
+	updateUser(w, r, modePatch)
+}
+
+func updateUser(w http.ResponseWriter, r *http.Request, mode inputMode) {
+	id, ok := userIDParam(w, r)
+	if !ok {
+		return
+	}
+	var in userInput
+	if err := readJSON(w, r, &in); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	errs := in.validate(mode)
+	if in.ID != nil && *in.ID != id {
+		if errs == nil {
+			errs = FieldErrors{}
+		}
+		errs["id"] = "must match the URL"
+	}
+	if errs != nil {
+		writeProblem(w, r, validationProblem(errs))
+		return
+	}
+
+	hash, err := in.passwordHash()
+	if err != nil {
+		writeUserStoreError(w, r, err)
+		return
+	}
+
+	// Modify does read-change-save under the store lock
+	user, err := userStore.Modify(id, func(u *User) error {
+		if in.Username != nil && *in.Username != u.Username {
+			return errUsernameChanged
+		}
+		in.apply(u, mode, hash)
+		return nil
+	})
+	if errors.Is(err, errUsernameChanged) {
+		writeProblem(w, r, validationProblem(FieldErrors{"username": "cannot be changed"}))
+		return
+	}
+	if err != nil {
+		writeUserStoreError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, user.Public())
+}
+
+// API: Delete user. Everything that logs in as them goes too: API
+// tokens, JWT logins and sessions.
+func apiDeleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := userIDParam(w, r)
+	if !ok {
+		return
+	}
+	user, err := userStore.GetByID(id)
+	if err != nil {
+		writeUserStoreError(w, r, err)
+		return
+	}
+	if err := userStore.Delete(id); err != nil {
+		writeUserStoreError(w, r, err)
+		return
+	}
+
+	// The account is gone either way, so report failures but carry on
+	tokens, err := tokenStore.RevokeUser(id)
+	if err != nil {
+		log.Printf("revoking tokens of deleted user %d: %v", id, err)
+	}
+	sessions, err := deleteUserSessions(user.Username)
+	if err != nil {
+		log.Printf("deleting sessions of deleted user %d: %v", id, err)
+	}
+	families := jwtIssuer.revokeUser(id)
+
+	auditLog.LogAttrs(r.Context(), slog.LevelInfo, "user deleted",
+		slog.Int("user_id", id),
+		slog.String("user", user.Username),
+		slog.String("by", currentSession(r).Username),
+		slog.Int("tokens", tokens),
+		slog.Int("sessions", sessions),
+		slog.Int("jwt_logins", families),
+		slog.String("request_id", requestID(r)),
+	)
+	w.WriteHeader(http.StatusNoContent)
+}
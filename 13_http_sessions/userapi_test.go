@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// usersAPI points the stores at fresh temporary ones and returns the
+// /api/users routes without the auth middleware in front
+func usersAPI(t *testing.T) (http.Handler, string) {
+	t.Helper()
+	withScryptDefaults(t, ScryptParams{LogN: 10, R: 8, P: 1})
+
+	path := filepath.Join(t.TempDir(), "users.json")
+	users, err := NewFileUserStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens, _ := NewFileTokenStore("")
+
+	savedUsers, savedTokens, savedStore := userStore, tokenStore, store
+	userStore, tokenStore, store = users, tokens, NewMemoryStore()
+	t.Cleanup(func() { userStore, tokenStore, store = savedUsers, savedTokens, savedStore })
+
+	rt := NewRouter()
+	g := rt.Group("/api/users")
+	g.Get("/", apiUsersHandler)
+	g.Get("/{id}", apiUserHandler)
+	g.Post("/", apiCreateUserHandler)
+	g.Put("/{id}", apiReplaceUserHandler)
+	g.Patch("/{id}", apiPatchUserHandler)
+	g.Delete("/{id}", apiDeleteUserHandler)
+	return rt, path
+}
+
+// call sends body as JSON, as admin, and decodes the response into a map
+func call(t *testing.T, h http.Handler, method, path, body string) (int, map[string]any, http.Header) {
+	t.Helper()
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	r = r.WithContext(context.WithValue(r.Context(), sessionCtxKey{}, &Session{Username: "admin"}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	var out map[string]any
+	if w.Body.Len() > 0 {
+		if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil {
+			t.Fatalf("%s %s: %v in %q", method, path, err, w.Body)
+		}
+	}
+	return w.Code, out, w.Header()
+}
+
+// The "errors" object of a problem response
+func fieldErrors(body map[string]any) map[string]any {
+	errs, _ := body["errors"].(map[string]any)
+	return errs
+}
+
+func TestUserAPICreate(t *testing.T) {
+	h, _ := usersAPI(t)
+
+	status, body, header := call(t, h, "POST", "/api/users",
+		`{"username":"alice","email":"alice@example.com","password":"password123"}`)
+	if status != http.StatusCreated {
+		t.Fatalf("create: %d %v", status, body)
+	}
+	if header.Get("Location") != "/api/users/1" || body["id"] != 1.0 {
+		t.Errorf("Location %q, id %v", header.Get("Location"), body["id"])
+	}
+	if _, leaked := body["password_hash"]; leaked {
+		t.Error("password hash in the response")
+	}
+	if roles, _ := body["roles"].([]any); len(roles) != 1 || roles[0] != "member" {
+		t.Errorf("default roles %v", body["roles"])
+	}
+
+	// Email is optional, and several users can leave it out
+	for _, name := range []string{"bob", "carol"} {
+		if status, body, _ := call(t, h, "POST", "/api/users", `{"username":"`+name+`","password":"password123"}`); status != http.StatusCreated {
+			t.Errorf("%s without email: %d %v", name, status, body)
+		}
+	}
+
+	tests := []struct {
+		name, body string
+		status     int
+		field      string
+	}{
+		{"missing password", `{"username":"dave"}`, 400, "password"},
+		{"short password", `{"username":"dave","password":"short"}`, 400, "password"},
+		{"bad username", `{"username":"a b","password":"password123"}`, 400, "username"},
+		{"bad email", `{"username":"dave","email":"nope","password":"password123"}`, 400, "email"},
+		{"unknown role", `{"username":"dave","password":"password123","roles":["king"]}`, 400, "roles"},
+		{"taken username", `{"username":"ALICE","password":"password123"}`, 409, "username"},
+		{"taken email", `{"username":"dave","email":"Alice@example.com","password":"password123"}`, 409, "email"},
+		{"unknown field", `{"username":"dave","password":"password123","admin":true}`, 400, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body, _ := call(t, h, "POST", "/api/users", tt.body)
+			if status != tt.status {
+				t.Fatalf("got %d, want %d: %v", status, tt.status, body)
+			}
+			if _, ok := fieldErrors(body)[tt.field]; tt.field != "" && !ok {
+				t.Errorf("no error for %q: %v", tt.field, body)
+			}
+		})
+	}
+}
+
+func TestUserAPIGet(t *testing.T) {
+	h, _ := usersAPI(t)
+	call(t, h, "POST", "/api/users", `{"username":"alice","password":"password123"}`)
+
+	if status, body, _ := call(t, h, "GET", "/api/users/1", ""); status != 200 || body["username"] != "alice" {
+		t.Errorf("get: %d %v", status, body)
+	}
+	if status, _, _ := call(t, h, "GET", "/api/users/2", ""); status != 404 {
+		t.Errorf("missing user: %d", status)
+	}
+	if status, _, _ := call(t, h, "GET", "/api/users/abc", ""); status != 400 {
+		t.Errorf("bad id: %d", status)
+	}
+	if status, body, _ := call(t, h, "GET", "/api/users", ""); status != 200 || len(body["data"].([]any)) != 1 {
+		t.Errorf("list: %d %v", status, body)
+	}
+}
+
+func TestUserAPIUpdate(t *testing.T) {
+	h, _ := usersAPI(t)
+	call(t, h, "POST", "/api/users", `{"username":"alice","name":"Alice","email":"alice@example.com","password":"password123"}`)
+	call(t, h, "POST", "/api/users", `{"username":"bob","password":"password123"}`)
+
+	// PATCH changes only what is sent
+	status, body, _ := call(t, h, "PATCH", "/api/users/1", `{"name":"Alice A."}`)
+	if status != 200 || body["name"] != "Alice A." || body["email"] != "alice@example.com" {
+		t.Fatalf("patch name: %d %v", status, body)
+	}
+	status, body, _ = call(t, h, "PATCH", "/api/users/1", `{"email":""}`)
+	if _, has := body["email"]; status != 200 || has {
+		t.Errorf("patch clearing email: %d %v", status, body)
+	}
+
+	// A GET response can be sent straight back as a PUT
+	_, got, _ := call(t, h, "GET", "/api/users/1", "")
+	got["name"] = "Alice B."
+	roundTrip, _ := json.Marshal(got)
+	if status, body, _ := call(t, h, "PUT", "/api/users/1", string(roundTrip)); status != 200 || body["name"] != "Alice B." {
+		t.Errorf("put round trip: %d %v", status, body)
+	}
+
+	// PUT replaces: leaving out name and email clears them
+	status, body, _ = call(t, h, "PUT", "/api/users/1", `{"username":"alice"}`)
+	if _, hasName := body["name"]; status != 200 || hasName {
+		t.Errorf("put without name: %d %v", status, body)
+	}
+
+	// The password still works after updates that didn't touch it
+	if _, err := authenticate(userStore, "alice", "password123"); err != nil {
+		t.Errorf("login after updates: %v", err)
+	}
+
+	tests := []struct {
+		name, method, path, body string
+		status                   int
+		field                    string
+	}{
+		{"rename by PATCH", "PATCH", "/api/users/1", `{"username":"alicia"}`, 400, "username"},
+		{"rename by PUT", "PUT", "/api/users/1", `{"username":"alicia"}`, 400, "username"},
+		{"rename case only", "PATCH", "/api/users/1", `{"username":"Alice"}`, 400, "username"},
+		{"same username", "PATCH", "/api/users/1", `{"username":"alice"}`, 200, ""},
+		{"PUT without username", "PUT", "/api/users/1", `{"name":"x"}`, 400, "username"},
+		{"PATCH empty username", "PATCH", "/api/users/1", `{"username":""}`, 400, "username"},
+		{"id mismatch", "PUT", "/api/users/1", `{"id":2,"username":"alice"}`, 400, "id"},
+		{"set email", "PATCH", "/api/users/2", `{"email":"bob@example.com"}`, 200, ""},
+		{"email taken", "PATCH", "/api/users/1", `{"email":"BOB@example.com"}`, 409, "email"},
+		{"missing user", "PATCH", "/api/users/9", `{"name":"x"}`, 404, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body, _ := call(t, h, tt.method, tt.path, tt.body)
+			if status != tt.status {
+				t.Fatalf("got %d, want %d: %v", status, tt.status, body)
+			}
+			if _, ok := fieldErrors(body)[tt.field]; tt.field != "" && !ok {
+				t.Errorf("no error for %q: %v", tt.field, body)
+			}
+		})
+	}
+
+	if u, _ := userStore.GetByID(1); u.Username != "alice" {
+		t.Errorf("username changed to %q", u.Username)
+	}
+}
+
+func TestUserAPIDelete(t *testing.T) {
+	h, _ := usersAPI(t)
+	call(t, h, "POST", "/api/users", `{"username":"alice","password":"password123"}`)
+	call(t, h, "POST", "/api/users", `{"username":"bob","password":"password123"}`)
+
+	now := time.Now()
+	store.Save("bob-session", &Session{Username: "bob", LastAccess: now, ExpiresAt: now.Add(time.Hour)})
+	store.Save("alice-session", &Session{Username: "alice", LastAccess: now, ExpiresAt: now.Add(time.Hour)})
+	bob, _ := userStore.GetByID(2)
+	secret, _, err := tokenStore.Create(bob, "ci", []string{"users:read"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status, _, _ := call(t, h, "DELETE", "/api/users/2", ""); status != http.StatusNoContent {
+		t.Fatalf("delete: %d", status)
+	}
+	if status, _, _ := call(t, h, "GET", "/api/users/2", ""); status != 404 {
+		t.Errorf("deleted user still found: %d", status)
+	}
+	if status, _, _ := call(t, h, "DELETE", "/api/users/2", ""); status != 404 {
+		t.Errorf("second delete: %d", status)
+	}
+
+	if _, err := store.Get("bob-session"); err == nil {
+		t.Error("deleted user's session survived")
+	}
+	if _, err := store.Get("alice-session"); err != nil {
+		t.Errorf("other user's session: %v", err)
+	}
+	if _, err := tokenStore.Lookup(secret, now); err == nil {
+		t.Error("deleted user's API token still works")
+	}
+}
+
+// IDs are never reused, even for the newest user after a restart
+func TestUserAPINextIDPersists(t *testing.T) {
+	h, path := usersAPI(t)
+	for _, name := range []string{"alice", "bob", "carol"} {
+		call(t, h, "POST", "/api/users", `{"username":"`+name+`","password":"password123"}`)
+	}
+	if status, _, _ := call(t, h, "DELETE", "/api/users/3", ""); status != http.StatusNoContent {
+		t.Fatalf("delete: %d", status)
+	}
+
+	// "Restart": load the same file into a new store
+	reloaded, err := NewFileUserStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userStore = reloaded
+	status, body, _ := call(t, h, "POST", "/api/users", `{"username":"dave","password":"password123"}`)
+	if status != http.StatusCreated || body["id"] != 4.0 {
+		t.Errorf("after restart: %d, id %v, want 4", status, body["id"])
+	}
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ==========================================
+// USER ACCOUNTS
+// ==========================================
+
+type User struct {
+	ID           int       `json:"id"`
+	Username     string    `json:"username"`
+	Name         string    `json:"name,omitempty"` // Display name
+	Email        string    `json:"email,omitempty"`
+	PasswordHash string    `json:"password_hash"`
+	Roles        []string  `json:"roles"`                 // See auth.go
+	Permissions  []string  `json:"permissions,omitempty"` // Granted on top of the roles
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// PublicUser is what the API shows: never the password hash
+type PublicUser struct {
+	ID          int       `json:"id"`
+	Username    string    `json:"username"`
+	Name        string    `json:"name,omitempty"`
+	Email       string    `json:"email,omitempty"`
+	Roles       []string  `json:"roles"`
+	Permissions []string  `json:"permissions,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+func (u *User) Public() PublicUser {
+	return PublicUser{
+		ID:          u.ID,
+		Username:    u.Username,
+		Name:        u.Name,
+		Email:       u.Email,
+		Roles:       u.Roles,
+		Permissions: u.Permissions,
+		CreatedAt:   u.CreatedAt,
+		UpdatedAt:   u.UpdatedAt,
+	}
+}
+
+var (
+	ErrUserNotFound   = errors.New("user not found")
+	ErrUserExists     = errors.New("username already taken")
+	ErrEmailTaken     = errors.New("email already in use")
+	ErrBadCredentials = errors.New("invalid username or password")
+)
+
+var usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9_.-]{3,32}$`)
+
+const minPasswordLen = 8
+
+// Field checks return a message fit to show the user, "" when fine
+
+func checkUsername(username string) string {
+	if !usernamePattern.MatchString(username) {
+		return "must be 3-32 letters, digits, '.', '_' or '-'"
+	}
+	return ""
+}
+
+func checkPassword(password string) string {
+	if len(password) < minPasswordLen {
+		return "must be at least 8 characters"
+	}
+	return ""
+}
+
+func checkEmail(email string) string {
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email { // No "Name <addr>" forms
+		return "must be a valid email address"
+	}
+	return ""
+}
+
+// Check registration input; the FieldErrors are fit to show the user
+func validateRegistration(username, email, password string) error {
+	errs := FieldErrors{}
+	if msg := checkUsername(username); msg != "" {
+		errs["username"] = msg
+	}
+	if msg := checkPassword(password); msg != "" {
+		errs["password"] = msg
+	}
+	if email != "" {
+		if msg := checkEmail(email); msg != "" {
+			errs["email"] = msg
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// ==========================================
+// USER STORE
+// ==========================================
+
+// UserStore is where accounts live. Usernames and emails are unique,
+// compared case-insensitively.
+type UserStore interface {
+	Create(user *User) error // Assigns user.ID
+	GetByID(id int) (*User, error)
+	GetByUsername(username string) (*User, error)
+	Update(user *User) error // Replaces the user with the same ID
+	// Modify runs fn on a copy of the user and saves the result, all under
+	// one lock, so concurrent changes to different fields aren't lost
+	Modify(id int, fn func(u *User) error) (*User, error)
+	Delete(id int) error
+	List() ([]*User, error) // Sorted by ID
+}
+
+// FileUserStore keeps users in memory and writes them to a JSON file on
+// every change. An empty path keeps them in memory only.
+type FileUserStore struct {
+	mu     sync.RWMutex
+	path   string
+	users  map[int]*User
+	byName map[string]int // Lowercased username -> ID
+	nextID int
+}
+
+// usersFile is the file's layout. next_id is saved so IDs are never
+// handed out twice: after deleting the newest user and restarting, the
+// highest remaining ID + 1 would be the deleted user's, and anything still
+// pointing at that ID (API tokens, logs, cached URLs) would find someone
+// else.
+type usersFile struct {
+	NextID int     `json:"next_id"`
+	Users  []*User `json:"users"`
+}
+
+func NewFileUserStore(path string) (*FileUserStore, error) {
+	s := &FileUserStore{
+		path:   path,
+		users:  make(map[int]*User),
+		byName: make(map[string]int),
+		nextID: 1,
+	}
+	if path == "" {
+		return s, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var file usersFile
+	if len(data) > 0 && data[0] == '[' { // Saved before next_id existed
+		err = json.Unmarshal(data, &file.Users)
+	} else if len(data) > 0 {
+		err = json.Unmarshal(data, &file)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.nextID = max(s.nextID, file.NextID)
+	for _, u := range file.Users {
+		if u.Roles == nil { // Saved before roles existed
+			u.Roles = slices.Clone(defaultRoles)
+		}
+		s.users[u.ID] = u
+		s.byName[strings.ToLower(u.Username)] = u.ID
+		if u.ID >= s.nextID {
+			s.nextID = u.ID + 1
+		}
+	}
+	return s, nil
+}
+
+func (s *FileUserStore) Create(user *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.conflict(user, 0); err != nil {
+		return err
+	}
+	user.ID = s.nextID
+	s.nextID++
+	copied := *user
+	s.users[user.ID] = &copied
+	s.byName[strings.ToLower(user.Username)] = user.ID
+	return s.persist()
+}
+
+// GetByID returns a copy, change it and call Update (or use Modify) to save
+func (s *FileUserStore) GetByID(id int) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u, ok := s.users[id]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	copied := *u
+	return &copied, nil
+}
+
+// GetByUsername returns a copy, like GetByID
+func (s *FileUserStore) GetByUsername(username string) (*User, error) {
+	s.mu.RLock()
+	id, ok := s.byName[strings.ToLower(username)]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	return s.GetByID(id)
+}
+
+func (s *FileUserStore) Update(user *User) error {
+	_, err := s.Modify(user.ID, func(u *User) error {
+		*u = *user
+		return nil
+	})
+	return err
+}
+
+func (s *FileUserStore) Modify(id int, fn func(u *User) error) (*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old, ok := s.users[id]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	updated := *old
+	if err := fn(&updated); err != nil {
+		return nil, err
+	}
+	updated.ID = id // fn can't move a user to another ID
+	if err := s.conflict(&updated, id); err != nil {
+		return nil, err
+	}
+
+	delete(s.byName, strings.ToLower(old.Username))
+	s.users[id] = &updated
+	s.byName[strings.ToLower(updated.Username)] = id
+	if err := s.persist(); err != nil {
+		return nil, err
+	}
+	copied := updated
+	return &copied, nil
+}
+
+func (s *FileUserStore) Delete(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[id]
+	if !ok {
+		return ErrUserNotFound
+	}
+	delete(s.users, id)
+	delete(s.byName, strings.ToLower(u.Username))
+	return s.persist()
+}
+
+func (s *FileUserStore) List() ([]*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.sorted(), nil
+}
+
+// Is the username or email already used by someone other than selfID?
+// Caller holds the lock.
+func (s *FileUserStore) conflict(user *User, selfID int) error {
+	if id, ok := s.byName[strings.ToLower(user.Username)]; ok && id != selfID {
+		return ErrUserExists
+	}
+	if user.Email == "" {
+		return nil
+	}
+	for id, other := range s.users {
+		if id != selfID && strings.EqualFold(other.Email, user.Email) {
+			return ErrEmailTaken
+		}
+	}
+	return nil
+}
+
+// Copies of all users ordered by ID. Caller holds the lock.
+func (s *FileUserStore) sorted() []*User {
+	list := make([]*User, 0, len(s.users))
+	for _, u := range s.users {
+		copied := *u
+		list = append(list, &copied)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// Write to a temp file and rename (same approach as FileStore).
+// Caller holds the write lock.
+func (s *FileUserStore) persist() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(usersFile{NextID: s.nextID, Users: s.sorted()}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".users-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// ==========================================
+// REGISTER / AUTHENTICATE
+// ==========================================
+
+// registerUser validates input, hashes the password and saves the account
+func registerUser(users UserStore, username, email, password string) (*User, error) {
+	email = strings.TrimSpace(email)
+	if err := validateRegistration(username, email, password); err != nil {
+		return nil, err
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	user := &User{
+		Username:     username,
+		Email:        email,
+		PasswordHash: hash,
+		Roles:        rolesFor(username),
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}
+	if err := users.Create(user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// Hash of a random password, checked against when the username doesn't
+// exist so both failure cases take the same time
+var dummyPasswordHash, _ = hashPassword(generateSessionID())
+
+// authenticate checks a username/password pair. If the stored hash uses
+// old parameters it is transparently upgraded.
+func authenticate(users UserStore, username, password string) (*User, error) {
+	user, err := users.GetByUsername(username)
+	if errors.Is(err, ErrUserNotFound) {
+		verifyPassword(password, dummyPasswordHash)
+		return nil, ErrBadCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ok, needsRehash, err := verifyPassword(password, user.PasswordHash)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrBadCredentials
+	}
+
+	if needsRehash {
+		if hash, err := hashPassword(password); err == nil {
+			// Best effort: login still succeeds if saving fails
+			users.Modify(user.ID, func(u *User) error {
+				u.PasswordHash = hash
+				return nil
+			})
+		}
+	}
+	return user, nil
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// ==========================================
+// WEBSOCKETS (RFC 6455)
+// ==========================================
+// A WebSocket starts as a normal GET with "Upgrade: websocket". We answer
+// 101 Switching Protocols, take over the TCP connection (Hijack) and from
+// then on both sides exchange frames:
+//
+//   byte 0     FIN bit + opcode (text, binary, close, ping, pong, ...)
+//   byte 1     MASK bit + payload length (126/127: longer length follows)
+//   [4 bytes]  masking key, always present on client frames
+//   payload    XORed with the masking key
+//
+// A message may be split into fragments (opcode 0 = continuation).
+// Control frames (close, ping, pong) may arrive between fragments.
+
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11" // Fixed by the RFC
+
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+// Close codes
+const (
+	wsCloseNormal        = 1000
+	wsCloseGoingAway     = 1001
+	wsCloseProtocolError = 1002
+	wsCloseUnsupported   = 1003
+	wsCloseNoStatus      = 1005 // Never sent, means "close frame had no code"
+	wsCloseInvalidData   = 1007
+	wsClosePolicy        = 1008
+	wsCloseTooBig        = 1009
+)
+
+const wsWriteTimeout = 10 * time.Second
+
+// WSCloseError is returned by ReadMessage when the connection is closed,
+// by the peer or because it broke the protocol
+type WSCloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *WSCloseError) Error() string {
+	return fmt.Sprintf("websocket closed: %d %s", e.Code, e.Reason)
+}
+
+// WSConn is one WebSocket connection. ReadMessage must only be called
+// from one goroutine; writes are safe from any.
+type WSConn struct {
+	MaxMessage int    // Longest message accepted, in bytes
+	OnPong     func() // Called for every pong (use it to extend the read deadline)
+
+	conn net.Conn
+	br   *bufio.Reader
+
+	writeMu   sync.Mutex
+	closeSent bool
+}
+
+// ==========================================
+// HANDSHAKE
+// ==========================================
+
+// upgradeWebSocket checks the handshake, answers 101 and takes over the
+// connection. If the request can't be upgraded nothing is written: the
+// returned *Problem says what to answer.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*WSConn, error) {
+	if !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket") {
+		w.Header().Set("Upgrade", "websocket")
+		return nil, NewProblem(http.StatusUpgradeRequired, "This endpoint only speaks WebSocket.")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		return nil, NewProblem(http.StatusUpgradeRequired, "Unsupported WebSocket version (want 13).")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if raw, err := base64.StdEncoding.DecodeString(key); err != nil || len(raw) != 16 {
+		return nil, NewProblem(http.StatusBadRequest, "Missing or malformed Sec-WebSocket-Key.")
+	}
+	// Browsers send the session cookie on WebSockets opened by any site,
+	// and CSRF tokens don't apply, so check where the page came from
+	// (sameOrigin is the same check csrfMiddleware does)
+	if !sameOrigin(r) {
+		return nil, NewProblem(http.StatusForbidden, "Cross-origin WebSocket connections are not allowed.")
+	}
+
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return nil, err // HTTP/2 connections can't be hijacked
+	}
+	conn.SetDeadline(time.Time{}) // Drop the server's read/write timeouts
+
+	ws := &WSConn{MaxMessage: 64 << 10, conn: conn, br: brw.Reader}
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + websocketAccept(key) + "\r\n\r\n"
+	conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	if _, err := io.WriteString(conn, response); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ws, nil
+}
+
+// The server proves it understood the handshake by hashing the key
+func websocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// headerHasToken checks comma-separated header values, case-insensitively
+// ("Connection: keep-alive, Upgrade")
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for part := range strings.SplitSeq(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ==========================================
+// READING
+// ==========================================
+
+// ReadMessage returns the next text or binary message. Pings are answered
+// and pongs reported to OnPong along the way. Any error means the
+// connection is done; a *WSCloseError tells why.
+func (c *WSConn) ReadMessage() (opcode int, data []byte, err error) {
+	for {
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch op {
+		case wsPing:
+			if err := c.write(wsPong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case wsPong:
+			if c.OnPong != nil {
+				c.OnPong()
+			}
+			continue
+		case wsClose:
+			e := parseClose(payload)
+			c.Close(e.Code, "") // Echo the close, as the RFC asks
+			return 0, nil, e
+		case wsText, wsBinary:
+			if opcode != 0 {
+				return 0, nil, c.fail(wsCloseProtocolError, "new message before the last one finished")
+			}
+			opcode = op
+		case wsContinuation:
+			if opcode == 0 {
+				return 0, nil, c.fail(wsCloseProtocolError, "continuation without a message")
+			}
+		default:
+			return 0, nil, c.fail(wsCloseProtocolError, fmt.Sprintf("unknown opcode %d", op))
+		}
+
+		if len(data)+len(payload) > c.MaxMessage {
+			return 0, nil, c.fail(wsCloseTooBig, fmt.Sprintf("messages are limited to %d bytes", c.MaxMessage))
+		}
+		data = append(data, payload...)
+		if fin {
+			if opcode == wsText && !utf8.Valid(data) {
+				return 0, nil, c.fail(wsCloseInvalidData, "text message is not valid UTF-8")
+			}
+			return opcode, data, nil
+		}
+	}
+}
+
+func (c *WSConn) readFrame() (fin bool, opcode int, payload []byte, err error) {
+	var head [2]byte
+	if _, err := io.ReadFull(c.br, head[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin = head[0]&0x80 != 0
+	opcode = int(head[0] & 0x0F)
+	masked := head[1]&0x80 != 0
+	length := uint64(head[1] & 0x7F)
+
+	if head[0]&0x70 != 0 {
+		return false, 0, nil, c.fail(wsCloseProtocolError, "reserved bits set (no extensions were negotiated)")
+	}
+	if !masked {
+		return false, 0, nil, c.fail(wsCloseProtocolError, "client frames must be masked")
+	}
+	if opcode >= wsClose && (!fin || length > 125) {
+		return false, 0, nil, c.fail(wsCloseProtocolError, "control frames must be short and unfragmented")
+	}
+
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	// Check before allocating, so a client can't claim a 1 TB frame
+	if length > uint64(c.MaxMessage) {
+		return false, 0, nil, c.fail(wsCloseTooBig, fmt.Sprintf("messages are limited to %d bytes", c.MaxMessage))
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+// The close payload is a 2-byte code followed by an optional reason
+func parseClose(payload []byte) *WSCloseError {
+	if len(payload) < 2 {
+		return &WSCloseError{Code: wsCloseNoStatus}
+	}
+	return &WSCloseError{Code: int(binary.BigEndian.Uint16(payload)), Reason: string(payload[2:])}
+}
+
+// fail closes the connection with code and returns the matching error
+func (c *WSConn) fail(code int, reason string) error {
+	c.Close(code, reason)
+	return &WSCloseError{Code: code, Reason: reason}
+}
+
+// ==========================================
+// WRITING
+// ==========================================
+
+// WriteText sends one text message
+func (c *WSConn) WriteText(data []byte) error { return c.write(wsText, data) }
+
+// Ping asks the client for a pong
+func (c *WSConn) Ping() error { return c.write(wsPing, nil) }
+
+// write sends one unfragmented frame. Server frames are never masked.
+func (c *WSConn) write(opcode int, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent {
+		return net.ErrClosed
+	}
+	return c.writeLocked(opcode, payload)
+}
+
+func (c *WSConn) writeLocked(opcode int, payload []byte) error {
+	frame := make([]byte, 0, 10+len(payload))
+	frame = append(frame, 0x80|byte(opcode))
+	switch n := len(payload); {
+	case n <= 125:
+		frame = append(frame, byte(n))
+	case n <= 0xFFFF:
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	frame = append(frame, payload...)
+
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// Close sends a close frame (once) and closes the connection
+func (c *WSConn) Close(code int, reason string) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if !c.closeSent {
+		c.closeSent = true
+		var payload []byte // 1005 is never put on the wire: send no code at all
+		if code != wsCloseNoStatus {
+			payload = append(binary.BigEndian.AppendUint16(nil, uint16(code)), reason...)
+		}
+		c.writeLocked(wsClose, payload)
+	}
+	return c.conn.Close()
+}
+
+// SetReadDeadline makes ReadMessage fail if nothing arrives by t
+func (c *WSConn) SetReadDeadline(t time.Time) error { return c.conn.SetReadDeadline(t) }
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// wsFrame builds a client frame, masked unless masked is false
+func wsFrame(fin bool, opcode int, payload []byte, masked bool) []byte {
+	b0 := byte(opcode)
+	if fin {
+		b0 |= 0x80
+	}
+	frame := []byte{b0}
+	var maskBit byte
+	if masked {
+		maskBit = 0x80
+	}
+	switch n := len(payload); {
+	case n <= 125:
+		frame = append(frame, maskBit|byte(n))
+	case n <= 0xFFFF:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	if !masked {
+		return append(frame, payload...)
+	}
+	mask := []byte{0x37, 0xfa, 0x21, 0x3d}
+	frame = append(frame, mask...)
+	for i, c := range payload {
+		frame = append(frame, c^mask[i%4])
+	}
+	return frame
+}
+
+// wsServerFrame is a frame the server sent (never masked, never fragmented)
+type wsServerFrame struct {
+	opcode  int
+	payload []byte
+}
+
+func parseServerFrames(t *testing.T, b []byte) []wsServerFrame {
+	t.Helper()
+	var frames []wsServerFrame
+	for len(b) > 0 {
+		if len(b) < 2 || b[0]&0x80 == 0 || b[1]&0x80 != 0 {
+			t.Fatalf("bad server frame: % x", b)
+		}
+		op, n := int(b[0]&0x0F), int(b[1]&0x7F)
+		b = b[2:]
+		switch n {
+		case 126:
+			n, b = int(binary.BigEndian.Uint16(b)), b[2:]
+		case 127:
+			n, b = int(binary.BigEndian.Uint64(b)), b[8:]
+		}
+		frames = append(frames, wsServerFrame{op, b[:n]})
+		b = b[n:]
+	}
+	return frames
+}
+
+// wsPipe feeds input to a server-side WSConn; done closes it and returns
+// the frames the server sent back
+func wsPipe(t *testing.T, input []byte) (ws *WSConn, done func() []wsServerFrame) {
+	server, client := net.Pipe()
+	go client.Write(input) // Fails once the server closes, that's fine
+	sent := make(chan []byte)
+	go func() {
+		b, _ := io.ReadAll(client)
+		sent <- b
+	}()
+	ws = &WSConn{MaxMessage: 1024, conn: server, br: bufio.NewReader(server)}
+	return ws, func() []wsServerFrame {
+		server.Close()
+		return parseServerFrames(t, <-sent)
+	}
+}
+
+func TestWSReadMessage(t *testing.T) {
+	frames := func(fs ...[]byte) []byte { return bytes.Join(fs, nil) }
+	long := func(n int) []byte { return bytes.Repeat([]byte("a"), n) }
+
+	tests := []struct {
+		name   string
+		input  []byte
+		opcode int // Message expected when close is 0
+		data   string
+		close  int // Close code the server must fail with
+	}{
+		{"text", wsFrame(true, wsText, []byte("hello"), true), wsText, "hello", 0},
+		{"binary", wsFrame(true, wsBinary, []byte{0, 1, 2}, true), wsBinary, "\x00\x01\x02", 0},
+		{"16-bit length", wsFrame(true, wsText, long(300), true), wsText, string(long(300)), 0},
+		{"fragmented", frames(
+			wsFrame(false, wsText, []byte("hel"), true),
+			wsFrame(false, wsContinuation, []byte("l"), true),
+			wsFrame(true, wsContinuation, []byte("o"), true),
+		), wsText, "hello", 0},
+		{"ping between fragments", frames(
+			wsFrame(false, wsText, []byte("hel"), true),
+			wsFrame(true, wsPing, []byte("p"), true),
+			wsFrame(true, wsPong, nil, true),
+			wsFrame(true, wsContinuation, []byte("lo"), true),
+		), wsText, "hello", 0},
+		// UTF-8 is checked on the whole message, not per fragment
+		{"rune split across fragments", frames(
+			wsFrame(false, wsText, []byte{0xC3}, true),
+			wsFrame(true, wsContinuation, []byte{0xA9}, true),
+		), wsText, "é", 0},
+
+		{"unmasked", wsFrame(true, wsText, []byte("hello"), false), 0, "", wsCloseProtocolError},
+		{"reserved bits", append([]byte{0xC1}, wsFrame(true, wsText, nil, true)[1:]...), 0, "", wsCloseProtocolError},
+		{"unknown opcode", wsFrame(true, 0x3, nil, true), 0, "", wsCloseProtocolError},
+		{"fragmented ping", wsFrame(false, wsPing, []byte("p"), true), 0, "", wsCloseProtocolError},
+		{"ping over 125 bytes", wsFrame(true, wsPing, long(126), true), 0, "", wsCloseProtocolError},
+		{"close over 125 bytes", wsFrame(true, wsClose, long(200), true), 0, "", wsCloseProtocolError},
+		{"new message mid-message", frames(
+			wsFrame(false, wsText, []byte("a"), true),
+			wsFrame(true, wsText, []byte("b"), true),
+		), 0, "", wsCloseProtocolError},
+		{"continuation first", wsFrame(true, wsContinuation, []byte("a"), true), 0, "", wsCloseProtocolError},
+		{"invalid UTF-8", wsFrame(true, wsText, []byte{'a', 0xFF}, true), 0, "", wsCloseInvalidData},
+		{"truncated rune", wsFrame(true, wsText, []byte{0xC3}, true), 0, "", wsCloseInvalidData},
+		{"frame over the limit", wsFrame(true, wsBinary, long(1025), true), 0, "", wsCloseTooBig},
+		{"fragments over the limit", frames(
+			wsFrame(false, wsBinary, long(1000), true),
+			wsFrame(true, wsContinuation, long(25), true),
+		), 0, "", wsCloseTooBig},
+		// Rejected from the header alone: nothing is allocated or read
+		{"64-bit length", append([]byte{0x82, 0x80 | 127}, binary.BigEndian.AppendUint64(nil, 1<<40)...), 0, "", wsCloseTooBig},
+		{"64-bit length with top bit", append([]byte{0x82, 0x80 | 127}, binary.BigEndian.AppendUint64(nil, 1<<63)...), 0, "", wsCloseTooBig},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ws, done := wsPipe(t, tt.input)
+			opcode, data, err := ws.ReadMessage()
+			sent := done()
+
+			if tt.close == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if opcode != tt.opcode || string(data) != tt.data {
+					t.Errorf("got %d %q, want %d %q", opcode, data, tt.opcode, tt.data)
+				}
+				return
+			}
+
+			var closeErr *WSCloseError
+			if !errors.As(err, &closeErr) || closeErr.Code != tt.close {
+				t.Fatalf("got %d %q, %v; want close %d", opcode, data, err, tt.close)
+			}
+			last := sent[len(sent)-1]
+			if last.opcode != wsClose || int(binary.BigEndian.Uint16(last.payload)) != tt.close {
+				t.Errorf("server sent %+v, want close %d", last, tt.close)
+			}
+		})
+	}
+}
+
+func TestWSPingPongAndClose(t *testing.T) {
+	ws, done := wsPipe(t, bytes.Join([][]byte{
+		wsFrame(true, wsPing, []byte("are you there"), true),
+		wsFrame(true, wsPong, nil, true),
+		wsFrame(true, wsClose, append(binary.BigEndian.AppendUint16(nil, wsCloseGoingAway), "bye"...), true),
+	}, nil))
+	pongs := 0
+	ws.OnPong = func() { pongs++ }
+
+	_, _, err := ws.ReadMessage()
+	var closeErr *WSCloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != wsCloseGoingAway || closeErr.Reason != "bye" {
+		t.Errorf("got %v", err)
+	}
+	if pongs != 1 {
+		t.Errorf("OnPong called %d times", pongs)
+	}
+	if err := ws.WriteText([]byte("late")); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("write after close: %v", err)
+	}
+
+	sent := done()
+	if len(sent) != 2 {
+		t.Fatalf("server sent %+v", sent)
+	}
+	if sent[0].opcode != wsPong || string(sent[0].payload) != "are you there" {
+		t.Errorf("ping answered with %+v", sent[0])
+	}
+	if sent[1].opcode != wsClose || binary.BigEndian.Uint16(sent[1].payload) != wsCloseGoingAway {
+		t.Errorf("close echoed as %+v", sent[1])
+	}
+
+	// A close without a code is echoed without one (1005 never goes on the wire)
+	ws, done = wsPipe(t, wsFrame(true, wsClose, nil, true))
+	if _, _, err := ws.ReadMessage(); !errors.As(err, &closeErr) || closeErr.Code != wsCloseNoStatus {
+		t.Errorf("got %v", err)
+	}
+	if sent := done(); len(sent) != 1 || sent[0].opcode != wsClose || len(sent[0].payload) != 0 {
+		t.Errorf("server sent %+v", sent)
+	}
+}
+
+func TestWSWriteLengths(t *testing.T) {
+	for _, n := range []int{0, 125, 126, 0xFFFF, 0x10000} {
+		ws, done := wsPipe(t, nil)
+		if err := ws.WriteText(bytes.Repeat([]byte("x"), n)); err != nil {
+			t.Fatal(err)
+		}
+		if sent := done(); len(sent) != 1 || sent[0].opcode != wsText || len(sent[0].payload) != n {
+			t.Errorf("%d bytes: sent %d frames", n, len(sent))
+		}
+	}
+}
+
+// The sample handshake from RFC 6455, section 1.3
+func TestWebsocketAccept(t *testing.T) {
+	if got := websocketAccept("dGhlIHNhbXBsZSBub25jZQ=="); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestUpgradeWebSocket(t *testing.T) {
+	upgraded := make(chan *WSConn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgradeWebSocket(w, r)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		upgraded <- ws
+	}))
+	defer srv.Close()
+
+	handshake := func(edit func(h http.Header)) *http.Request {
+		r, _ := http.NewRequest("GET", srv.URL+"/ws", nil)
+		r.Header.Set("Connection", "keep-alive, Upgrade")
+		r.Header.Set("Upgrade", "websocket")
+		r.Header.Set("Sec-WebSocket-Version", "13")
+		r.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		if edit != nil {
+			edit(r.Header)
+		}
+		return r
+	}
+	tests := []struct {
+		name string
+		edit func(h http.Header)
+		want int
+	}{
+		{"plain GET", func(h http.Header) { h.Del("Upgrade") }, http.StatusUpgradeRequired},
+		{"old version", func(h http.Header) { h.Set("Sec-WebSocket-Version", "8") }, http.StatusUpgradeRequired},
+		{"no key", func(h http.Header) { h.Del("Sec-WebSocket-Key") }, http.StatusBadRequest},
+		{"short key", func(h http.Header) { h.Set("Sec-WebSocket-Key", "c2hvcnQ=") }, http.StatusBadRequest},
+		{"other origin", func(h http.Header) { h.Set("Origin", "https://evil.example") }, http.StatusForbidden},
+		{"null origin", func(h http.Header) { h.Set("Origin", "null") }, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := http.DefaultClient.Do(handshake(tt.edit))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.want {
+				t.Errorf("got %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+
+	// A real upgrade, over a raw connection
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := handshake(func(h http.Header) { h.Set("Origin", srv.URL) })
+	if err := r.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols ||
+		resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" ||
+		!strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") {
+		t.Fatalf("got %d %v", resp.StatusCode, resp.Header)
+	}
+
+	ws := <-upgraded
+	defer ws.Close(wsCloseNormal, "")
+	conn.Write(wsFrame(true, wsText, []byte("hi"), true))
+	if _, data, err := ws.ReadMessage(); err != nil || string(data) != "hi" {
+		t.Errorf("first message: %q, %v", data, err)
+	}
+}